@@ -2,3 +2,5 @@
 
 rm bosh-stemcell-*.tgz
 rm light-bosh-stemcell-*.tgz
+rm -f bosh-stemcell-*.tgz.part light-bosh-stemcell-*.tgz.part
+rm -f bosh-stemcell-*.tgz.corrupt light-bosh-stemcell-*.tgz.corrupt
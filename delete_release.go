@@ -5,8 +5,8 @@ package main
 import (
 	"fmt"
 	"os"
-	"strconv"
 
+	"github.com/mgoelzer/stemcells/httplib"
 	"github.com/mgoelzer/stemcells/pivnetlib"
 
 	"github.com/codegangsta/cli"
@@ -23,7 +23,8 @@ FLAGS
   {{end}}
 
 EXAMPLE
-  delete_release 512
+  delete_release 3026
+  delete_release id:512
 `
 
 const pivnetProductSlug = "stemcells"
@@ -33,13 +34,72 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "delete_release"
 	app.Version = "0.1.0"
-	app.Usage = fmt.Sprintf("%s [FLAGS] RELEASE_ID", app.Name)
+	app.Usage = fmt.Sprintf("%s [FLAGS] RELEASE_ID|VERSION", app.Name)
 	app.Commands = nil
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
 			Name:  "run-tests, t",
 			Usage: "whether to run the unit tests",
 		},
+		cli.StringFlag{
+			Name:  "pivnet-url",
+			Value: pivnetlib.DefaultBaseUrl,
+			Usage: "base URL of the Pivnet API, e.g. a staging instance",
+		},
+		cli.StringFlag{
+			Name:  "token",
+			Usage: "Pivnet API token or UAA refresh token (default $PIVNET_TOKEN, then pivnet_token in " + pivnetlib.DefaultConfigFile() + ")",
+		},
+		cli.StringFlag{
+			Name:  "token-file",
+			Usage: "file holding the Pivnet API token or UAA refresh token",
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "log Pivnet requests and replies to stderr",
+		},
+		cli.StringFlag{
+			Name:  "proxy",
+			Usage: "HTTP(S) proxy URL for all requests, e.g. http://proxy:3128 (default $HTTPS_PROXY/$HTTP_PROXY)",
+		},
+		cli.StringFlag{
+			Name:   "no-proxy",
+			Usage:  "comma-separated hosts, domains and CIDRs to reach without the proxy (default $NO_PROXY)",
+			EnvVar: "NO_PROXY,no_proxy",
+		},
+		cli.StringFlag{
+			Name:   "proxy-user",
+			Usage:  "USER:PASSWORD for the proxy, if it isn't in the proxy URL",
+			EnvVar: "PROXY_USER",
+		},
+		cli.StringSliceFlag{
+			Name:  "ca-cert",
+			Value: &cli.StringSlice{},
+			Usage: "PEM file of extra CA certificates to trust (repeatable)",
+		},
+		cli.StringFlag{
+			Name:  "client-cert",
+			Usage: "PEM client certificate to present (with --client-key)",
+		},
+		cli.StringFlag{
+			Name:  "client-key",
+			Usage: "PEM private key for --client-cert",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Value: httplib.DefaultRetryPolicy.MaxAttempts - 1,
+			Usage: "how many times to retry a failed request or broken download (0 to never retry)",
+		},
+		cli.DurationFlag{
+			Name:  "retry-delay",
+			Value: httplib.DefaultRetryPolicy.InitialDelay,
+			Usage: "backoff before the first retry, doubling (with jitter) after that",
+		},
+		cli.DurationFlag{
+			Name:  "retry-max-delay",
+			Value: httplib.DefaultRetryPolicy.MaxDelay,
+			Usage: "longest to wait between retries, including for Retry-After",
+		},
 	}
 	cli.AppHelpTemplate = appHelpTemplate
 
@@ -53,16 +113,25 @@ func main() {
 			os.Exit(255)
 		}
 		vArg := c.Args()[0]
-		releaseId, err := strconv.Atoi(vArg)
-		if (err != nil) || (releaseId <= 0) || (releaseId > 999999) {
-			fmt.Printf("Error:  need a numeric pivnet release id (try --help)\n")
+
+		if err := configureHttp(c); err != nil {
+			fmt.Printf("Error:  %v (try --help)\n", err)
+			os.Exit(255)
+		}
+
+		// A version, a release id, or either spelled out as version:V or id:N
+		release, err := pivnetClient.ResolveRelease(pivnetProductSlug, vArg)
+		if err != nil {
+			fmt.Printf("Error:  %v\n", err)
 			os.Exit(255)
 		}
+		releaseId := release.Id
+		fmt.Printf("Deleting release %v (version %v)\n", releaseId, release.Version)
 
-		err = pivnetlib.DeleteRelease(pivnetProductSlug, releaseId)
+		err = pivnetClient.DeleteRelease(pivnetProductSlug, releaseId)
 		if err != nil {
-			fmt.Printf("\nERROR: %v\n", err)
-			return
+			fmt.Printf("Error:  %v\n", err)
+			os.Exit(255)
 		} else {
 			fmt.Printf("\nDeleteRelease on %v: ok\n", releaseId)
 		}
@@ -70,3 +139,34 @@ func main() {
 	}
 	app.Run(os.Args)
 }
+
+// The Pivnet client configureHttp built
+var pivnetClient *pivnetlib.Client
+
+// Builds the Pivnet client from the proxy, TLS, retry and Pivnet flags
+func configureHttp(c *cli.Context) error {
+	client, err := httplib.Configure(httplib.Settings{
+		Config: httplib.Config{
+			ProxyUrl:       c.GlobalString("proxy"),
+			NoProxy:        c.GlobalString("no-proxy"),
+			ProxyUser:      c.GlobalString("proxy-user"),
+			CaFiles:        c.GlobalStringSlice("ca-cert"),
+			ClientCertFile: c.GlobalString("client-cert"),
+			ClientKeyFile:  c.GlobalString("client-key"),
+		},
+		Retries:       c.GlobalInt("retries"),
+		RetryDelay:    c.GlobalDuration("retry-delay"),
+		RetryMaxDelay: c.GlobalDuration("retry-max-delay"),
+	})
+	if err != nil {
+		return err
+	}
+	pivnetClient = pivnetlib.NewClientFromSettings(pivnetlib.Settings{
+		BaseUrl:   c.GlobalString("pivnet-url"),
+		Token:     c.GlobalString("token"),
+		TokenFile: c.GlobalString("token-file"),
+		Debug:     c.GlobalBool("debug"),
+		Program:   c.App.Name + "/" + c.App.Version,
+	}, client)
+	return nil
+}
@@ -0,0 +1,42 @@
+package httplib
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Sends HTTP requests.  *http.Client satisfies it; tests can swap in a fake.
+type Transport interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// A client that keeps connections open between requests to the same host,
+// which matters when several stemcells come from the same bucket
+func NewClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   8,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
+// Formats response headers the way they appear on the wire, one per line
+func FormatHeaders(resp *http.Response) string {
+	s := resp.Proto + " " + resp.Status + "\n"
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			s += k + ": " + v + "\n"
+		}
+	}
+	return s
+}
@@ -0,0 +1,199 @@
+package httplib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Network settings shared by everything that talks HTTP: bosh.io and mirror
+// downloads as well as the Pivnet API.  The zero value behaves like a plain
+// client that honors HTTPS_PROXY/HTTP_PROXY/NO_PROXY.
+type Config struct {
+	ProxyUrl       string   // overrides HTTPS_PROXY/HTTP_PROXY when set
+	NoProxy        string   // hosts that skip the proxy, on top of NO_PROXY
+	ProxyUser      string   // "user:password", if not already in the proxy URL
+	CaFiles        []string // PEM bundles trusted on top of the system roots
+	ClientCertFile string   // PEM client certificate, with ClientKeyFile
+	ClientKeyFile  string
+}
+
+// A client like NewClient's, set up from cfg
+func NewClientFromConfig(cfg Config) (*http.Client, error) {
+	client := NewClient()
+	transport := client.Transport.(*http.Transport)
+
+	proxy, err := cfg.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = proxy
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return client, nil
+}
+
+// Picks the proxy for each request: cfg.ProxyUrl if set, else the
+// environment, either way with cfg.ProxyUser filled in
+func (cfg Config) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	var user *url.Userinfo
+	if cfg.ProxyUser != "" {
+		parts := strings.SplitN(cfg.ProxyUser, ":", 2)
+		if len(parts) == 2 {
+			user = url.UserPassword(parts[0], parts[1])
+		} else {
+			user = url.User(parts[0])
+		}
+	}
+	withUser := func(proxyUrl *url.URL) *url.URL {
+		if proxyUrl != nil && proxyUrl.User == nil && user != nil {
+			u := *proxyUrl
+			u.User = user
+			return &u
+		}
+		return proxyUrl
+	}
+
+	noProxy := cfg.NoProxy
+	if cfg.ProxyUrl == "" {
+		return func(req *http.Request) (*url.URL, error) {
+			if bypassProxy(req.URL, noProxy) {
+				return nil, nil
+			}
+			proxyUrl, err := http.ProxyFromEnvironment(req)
+			return withUser(proxyUrl), err
+		}, nil
+	}
+
+	// Like curl, "proxy:3128" means http://proxy:3128
+	rawProxyUrl := cfg.ProxyUrl
+	if !strings.Contains(rawProxyUrl, "://") {
+		rawProxyUrl = "http://" + rawProxyUrl
+	}
+	proxyUrl, err := url.Parse(rawProxyUrl)
+	if err != nil || proxyUrl.Hostname() == "" {
+		return nil, errors.New(fmt.Sprintf("bad proxy URL '%v'", cfg.ProxyUrl))
+	}
+	proxyUrl = withUser(proxyUrl)
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return proxyUrl, nil
+	}, nil
+}
+
+// Whether a NO_PROXY-style list (comma-separated hosts, .domains, IPs or
+// CIDRs, or "*") says to go direct.  Loopback never goes through the proxy.
+func bypassProxy(u *url.URL, noProxy string) bool {
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, port, err := net.SplitHostPort(entry); err == nil {
+			if port != u.Port() {
+				continue
+			}
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		h := strings.ToLower(host)
+		if h == strings.TrimPrefix(entry, ".") || strings.HasSuffix(h, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// System roots plus cfg.CaFiles, and the client certificate if there is one
+func (cfg Config) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if len(cfg.CaFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range cfg.CaFiles {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New(fmt.Sprintf("no PEM certificates in %v", caFile))
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		if cfg.ClientCertFile == "" || cfg.ClientKeyFile == "" {
+			return nil, errors.New("a client certificate needs both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("can't load client certificate: %v", err))
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Everything a command line says about HTTP: the network Config plus the
+// retry policy and bandwidth limit every request shares
+type Settings struct {
+	Config
+	Retries       int // after the first attempt; 0 to never retry
+	RetryDelay    time.Duration
+	RetryMaxDelay time.Duration
+	LimitRate     string // e.g. "20MiB/s"; "" for no limit
+}
+
+// Sets DefaultRetryPolicy and DefaultRateLimiter from s, and returns the one
+// client to use for everything
+func Configure(s Settings) (*http.Client, error) {
+	if s.Retries < 0 {
+		return nil, errors.New("--retries can't be negative")
+	}
+	DefaultRetryPolicy.MaxAttempts = s.Retries + 1
+	DefaultRetryPolicy.InitialDelay = s.RetryDelay
+	DefaultRetryPolicy.MaxDelay = s.RetryMaxDelay
+
+	if s.LimitRate != "" {
+		bytesPerSecond, err := ParseRate(s.LimitRate)
+		if err != nil {
+			return nil, err
+		}
+		DefaultRateLimiter = NewRateLimiter(bytesPerSecond)
+	}
+	return NewClientFromConfig(s.Config)
+}
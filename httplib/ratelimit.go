@@ -0,0 +1,113 @@
+package httplib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A token bucket shared by every transfer that reads or writes through it, so
+// that together they stay under one rate
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Limits downloads and uploads when set (by the CLI's --limit-rate); nil
+// means no limit
+var DefaultRateLimiter *RateLimiter
+
+// A limiter for bytesPerSecond, or nil (no limit) if that's 0
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	// Enough for a 32KiB io.Copy buffer, or a tenth of a second at high rates
+	burst := float64(bytesPerSecond) / 10
+	if burst < 32*1024 {
+		burst = 32 * 1024
+	}
+	return &RateLimiter{rate: float64(bytesPerSecond), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Blocks until n more bytes may be transferred.  Callers queue up: each one
+// takes its tokens at once, going into debt if need be, and sleeps off its
+// share.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// Wraps r so reading from it is limited; r itself if l is nil
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	// Small reads keep a fast link from bursting past the limit
+	if max := int(lr.l.burst); len(p) > max {
+		p = p[:max]
+	}
+	n, err := lr.r.Read(p)
+	lr.l.Wait(n)
+	return n, err
+}
+
+var rateRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([kmgt]?)(i?)(b?)(?:/s)?$`)
+
+// Parses a rate like "20MiB/s", "500KB/s", "1.5M" or "65536" into bytes per
+// second.  K, M, G and T alone are powers of 1024, as with curl; "KB" and
+// friends are powers of 1000.
+func ParseRate(s string) (int64, error) {
+	m := rateRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, errors.New(fmt.Sprintf("bad rate '%v' (want e.g. 20MiB/s, 500KB/s or 1M)", s))
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	base := 1024.0
+	if m[3] == "" && m[4] == "b" {
+		base = 1000
+	}
+	if m[2] != "" {
+		value *= math.Pow(base, float64(strings.Index("kmgt", m[2])+1))
+	}
+	if value < 1 {
+		return 0, errors.New(fmt.Sprintf("rate '%v' is too low", s))
+	}
+	return int64(value), nil
+}
@@ -0,0 +1,115 @@
+package httplib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want int64
+	}{
+		{"65536", 65536},
+		{"100B/s", 100},
+		{"100b", 100},
+		{"500k", 500 * 1024},
+		{"500K", 500 * 1024},
+		{"500KiB/s", 500 * 1024},
+		{"500KB/s", 500 * 1000},
+		{"500kb", 500 * 1000},
+		{"20M", 20 << 20},
+		{"20MiB/s", 20 << 20},
+		{"20MB/s", 20 * 1000 * 1000},
+		{"1.5M", 3 << 19},
+		{"2G", 2 << 30},
+		{"2GB/s", 2 * 1000 * 1000 * 1000},
+		{"1T", 1 << 40},
+		{" 20 MiB/s ", 20 << 20},
+	} {
+		got, err := ParseRate(tc.s)
+		if err != nil || got != tc.want {
+			t.Errorf("%q: got %v (%v), want %v", tc.s, got, err, tc.want)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"0",
+		"0M",
+		"0.5", // less than a byte a second
+		"-1M",
+		"-20MiB/s",
+		"fast",
+		"20X",
+		"20MiB/h",
+		"M",
+		"20 M B",
+		"1e6",
+	} {
+		if got, err := ParseRate(s); err == nil {
+			t.Errorf("%q: got %v, want an error", s, got)
+		}
+	}
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		if l := NewRateLimiter(rate); l != nil {
+			t.Errorf("got a limiter for %v bytes/s, want none", rate)
+		}
+	}
+
+	// A nil limiter doesn't limit
+	var l *RateLimiter
+	l.Wait(1 << 30)
+	r := bytes.NewReader(nil)
+	if l.Reader(r) != io.Reader(r) {
+		t.Errorf("a nil limiter wrapped the reader")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	// 1MiB/s; the first 100KiB or so are the burst, the rest has to wait
+	l := NewRateLimiter(1 << 20)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		l.Wait(32 * 1024)
+	}
+	l.Wait(int(l.burst)) // spend the burst again
+	elapsed := time.Since(start)
+	want := time.Duration(float64(320*1024) / float64(1<<20) * float64(time.Second))
+	if elapsed < want*8/10 || elapsed > want*3 {
+		t.Errorf("320KiB plus a burst at 1MiB/s took %v, want about %v", elapsed, want)
+	}
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	// Four readers together get the rate of one
+	l := NewRateLimiter(4 << 20)
+	data := make([]byte, 512*1024)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(ioutil.Discard, l.Reader(bytes.NewReader(data)))
+			if err != nil || n != int64(len(data)) {
+				t.Errorf("read %v bytes (%v), want %v", n, err, len(data))
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// 2MiB at 4MiB/s, less the burst
+	want := 2*time.Second/4 - time.Duration(l.burst/l.rate*float64(time.Second))
+	if elapsed < want*8/10 || elapsed > want*3 {
+		t.Errorf("2MiB at 4MiB/s took %v, want about %v", elapsed, want)
+	}
+}
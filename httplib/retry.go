@@ -0,0 +1,195 @@
+package httplib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// How often and how patiently failed requests are retried
+type RetryPolicy struct {
+	MaxAttempts  int           // including the first; 1 means never retry
+	InitialDelay time.Duration // before the first retry, doubling after that
+	MaxDelay     time.Duration // cap on the backoff (and on Retry-After)
+
+	// Where retries are reported; nil for stderr
+	Logf func(format string, args ...interface{})
+}
+
+// Used by everything that doesn't say otherwise; the CLI sets it from flags
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 1 * time.Second,
+	MaxDelay:     60 * time.Second,
+}
+
+// Returns p, or DefaultRetryPolicy if p is nil
+func (p *RetryPolicy) OrDefault() *RetryPolicy {
+	if p == nil {
+		return DefaultRetryPolicy
+	}
+	return p
+}
+
+// Whether a request that got resp/err is worth trying again: network errors,
+// timeouts, 408, 429 and 5xx other than 501.  Errors that would only happen
+// again are not: a cancelled or expired context, a certificate that doesn't
+// verify, or a URL that can't be requested at all.
+func Retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) &&
+			!certificateError(err) && !invalidUrl(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented:
+		return false
+	}
+	return resp.StatusCode >= 500
+}
+
+func certificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var verification *tls.CertificateVerificationError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) ||
+		errors.As(err, &hostname) || errors.As(err, &verification)
+}
+
+// A request error about the URL itself: one that doesn't parse, or isn't
+// http(s) with a host
+func invalidUrl(err error) bool {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return false
+	}
+	if urlErr.Op == "parse" {
+		return true
+	}
+	u, parseErr := url.Parse(urlErr.URL)
+	return parseErr != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https")
+}
+
+// How long to wait before attempt number attempt+1 (attempt counts from 1).
+// A Retry-After header on a 429 or 503 wins; otherwise it's exponential
+// backoff with full jitter.
+func (p *RetryPolicy) Delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if d, ok := retryAfter(resp); ok {
+			if p.MaxDelay > 0 && d > p.MaxDelay {
+				d = p.MaxDelay
+			}
+			return d
+		}
+	}
+	backoff := p.InitialDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || backoff < p.MaxDelay); i++ {
+		backoff *= 2
+	}
+	if p.MaxDelay > 0 && backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+// Retry-After as either seconds or an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// Reports what is about to be retried, and then waits
+func (p *RetryPolicy) Wait(what string, attempt int, resp *http.Response, err error) {
+	delay := p.Delay(attempt, resp)
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	} else if resp != nil {
+		reason = "HTTP " + resp.Status
+	}
+	logf := p.Logf
+	if logf == nil {
+		logf = func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format, args...)
+		}
+	}
+	logf("Retrying %v in %v (attempt %v of %v failed: %v)\n", what, delay.Round(time.Millisecond), attempt, p.MaxAttempts, reason)
+	time.Sleep(delay)
+}
+
+// Calls send until it succeeds, fails in a way that isn't Retryable, or runs
+// out of attempts.  Bodies of responses that are retried are closed; the last
+// response is returned as is for the caller to check.
+func (p *RetryPolicy) Do(what string, send func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := send()
+		if attempt >= p.MaxAttempts || !Retryable(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		p.Wait(what, attempt, resp, err)
+	}
+}
+
+// A Transport that retries requests it knows are safe to repeat (GET, HEAD,
+// OPTIONS, PUT and DELETE).  Anything else, e.g. POST, is sent once; callers
+// that can spot duplicates do their own retrying.
+type RetryTransport struct {
+	Transport Transport
+	Policy    *RetryPolicy // nil for DefaultRetryPolicy
+}
+
+func (t *RetryTransport) Do(req *http.Request) (*http.Response, error) {
+	if !Idempotent(req.Method) || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return t.Transport.Do(req)
+	}
+	attempt := 0
+	return t.Policy.OrDefault().Do(req.Method+" "+req.URL.String(), func() (*http.Response, error) {
+		attempt++
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		return t.Transport.Do(req)
+	})
+}
+
+// Methods that can be repeated without doing anything twice
+func Idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package httplib
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusPartialContent, false},
+		{http.StatusNotFound, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusNotImplemented, false},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+	} {
+		if got := Retryable(&http.Response{StatusCode: tc.status}, nil); got != tc.want {
+			t.Errorf("HTTP %v: got %v, want %v", tc.status, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection reset", &url.Error{Op: "Get", URL: "https://bosh.io/", Err: errors.New("connection reset by peer")}, true},
+		{"cancelled", &url.Error{Op: "Get", URL: "https://bosh.io/", Err: context.Canceled}, false},
+		{"deadline", fmt.Errorf("fetching: %w", context.DeadlineExceeded), false},
+		{"unknown CA", &url.Error{Op: "Get", URL: "https://bosh.io/", Err: x509.UnknownAuthorityError{}}, false},
+		{"wrong host", &url.Error{Op: "Get", URL: "https://bosh.io/", Err: x509.HostnameError{Host: "bosh.io"}}, false},
+		{"expired", &url.Error{Op: "Get", URL: "https://bosh.io/", Err: x509.CertificateInvalidError{Reason: x509.Expired}}, false},
+		{"bad scheme", &url.Error{Op: "Get", URL: "ftp://bosh.io/", Err: errors.New(`unsupported protocol scheme "ftp"`)}, false},
+		{"no host", &url.Error{Op: "Get", URL: "http:///d/stemcells", Err: errors.New("no Host in request URL")}, false},
+		{"unparseable", &url.Error{Op: "parse", URL: "http://bosh.io/%zz", Err: errors.New("invalid URL escape")}, false},
+	} {
+		if got := Retryable(nil, tc.err); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRetryableCertificate(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	// The test server's certificate isn't signed by anything we trust
+	_, err := NewClient().Get(s.URL)
+	if err == nil {
+		t.Fatal("got no error from a server with an untrusted certificate")
+	}
+	if Retryable(nil, err) {
+		t.Errorf("%v is retryable", err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	p := &RetryPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second}
+	for _, tc := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second}, // no overflow
+	} {
+		for i := 0; i < 100; i++ {
+			if d := p.Delay(tc.attempt, nil); d <= 0 || d > tc.max {
+				t.Errorf("attempt %v: got %v, want up to %v", tc.attempt, d, tc.max)
+				break
+			}
+		}
+	}
+
+	if d := (&RetryPolicy{}).Delay(3, nil); d != 0 {
+		t.Errorf("got %v with no initial delay, want 0", d)
+	}
+}
+
+func TestDelayRetryAfter(t *testing.T) {
+	p := &RetryPolicy{InitialDelay: time.Millisecond, MaxDelay: time.Minute}
+	respond := func(status int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		resp.Header.Set("Retry-After", retryAfter)
+		return resp
+	}
+
+	for _, tc := range []struct {
+		name string
+		resp *http.Response
+		min  time.Duration
+		max  time.Duration
+	}{
+		{"seconds on 429", respond(http.StatusTooManyRequests, "7"), 7 * time.Second, 7 * time.Second},
+		{"seconds on 503", respond(http.StatusServiceUnavailable, "0"), 0, 0},
+		{"capped", respond(http.StatusServiceUnavailable, "3600"), time.Minute, time.Minute},
+		{"date", respond(http.StatusServiceUnavailable, time.Now().Add(30*time.Second).UTC().Format(http.TimeFormat)), 28 * time.Second, 30 * time.Second},
+		{"date in the past", respond(http.StatusTooManyRequests, "Wed, 21 Oct 2015 07:28:00 GMT"), 0, 0},
+		{"ignored on 500", respond(http.StatusInternalServerError, "7"), 1, time.Millisecond},
+		{"garbage", respond(http.StatusServiceUnavailable, "soon"), 1, time.Millisecond},
+		{"negative", respond(http.StatusServiceUnavailable, "-5"), 1, time.Millisecond},
+	} {
+		if d := p.Delay(1, tc.resp); d < tc.min || d > tc.max {
+			t.Errorf("%v: got %v, want %v to %v", tc.name, d, tc.min, tc.max)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	var logged []string
+	p := &RetryPolicy{MaxAttempts: 3, Logf: func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}}
+	respond := func(statuses ...int) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			status := statuses[0]
+			statuses = statuses[1:]
+			return &http.Response{StatusCode: status, Status: fmt.Sprint(status), Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+	}
+
+	for _, tc := range []struct {
+		statuses []int
+		want     int
+		retries  int
+	}{
+		{[]int{200}, 200, 0},
+		{[]int{503, 502, 200}, 200, 2},
+		{[]int{503, 503, 503}, 503, 2}, // out of attempts
+		{[]int{404}, 404, 0},
+	} {
+		logged = nil
+		resp, err := p.Do("GET x", respond(tc.statuses...))
+		if err != nil || resp.StatusCode != tc.want || len(logged) != tc.retries {
+			t.Errorf("%v: got %v (%v) after %v retries, want %v after %v", tc.statuses, resp.StatusCode, err, len(logged), tc.want, tc.retries)
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	requests := map[string]int{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.Method]++
+		if body, _ := ioutil.ReadAll(r.Body); r.Method == "PUT" && string(body) != "data" {
+			t.Errorf("attempt %v of the PUT got body %q", requests[r.Method], body)
+		}
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+	transport := &RetryTransport{Transport: &http.Client{}, Policy: &RetryPolicy{MaxAttempts: 3, Logf: t.Logf}}
+
+	for _, method := range []string{"GET", "PUT", "POST"} {
+		req, _ := http.NewRequest(method, s.URL, strings.NewReader("data"))
+		resp, err := transport.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if requests["GET"] != 3 || requests["PUT"] != 3 || requests["POST"] != 1 {
+		t.Errorf("got requests %v, want 3 GETs, 3 PUTs and 1 POST", requests)
+	}
+}
@@ -0,0 +1,176 @@
+package pivnetlib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mgoelzer/stemcells/httplib"
+)
+
+// Legacy API tokens are exactly this long; UAA refresh tokens are longer
+const legacyTokenLength = 20
+
+const (
+	// Assumed when an access token doesn't say when it expires
+	defaultAccessTokenLifetime = 10 * time.Minute
+	// How long before it expires an access token is replaced
+	accessTokenMargin = time.Minute
+)
+
+// Whether a token is a UAA refresh token (to be exchanged for access tokens)
+// rather than a legacy API token (sent as is)
+func IsRefreshToken(token string) bool {
+	return len(token) > legacyTokenLength
+}
+
+// Turns the token from a TokenSource into an Authorization header: "Token
+// ..." for a legacy token, or "Bearer ..." with an access token exchanged for
+// a refresh token and kept until shortly before it expires
+type authenticator struct {
+	client    *Client
+	tokens    TokenSource
+	transport httplib.Transport // without reauthTransport, or exchanges would loop
+
+	mutex        sync.Mutex
+	refreshToken string // what accessToken was exchanged for
+	accessToken  string
+	expires      time.Time
+}
+
+func (a *authenticator) header() (string, error) {
+	token, err := a.tokens.Token()
+	if err != nil {
+		return "", err
+	}
+	if !IsRefreshToken(token) {
+		return "Token " + token, nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if token != a.refreshToken || a.accessToken == "" || time.Now().After(a.expires.Add(-accessTokenMargin)) {
+		accessToken, expires, err := a.exchange(token)
+		if err != nil {
+			return "", err
+		}
+		a.refreshToken, a.accessToken, a.expires = token, accessToken, expires
+		a.client.logf("Got an access token good until %v\n", expires.Format(time.RFC3339))
+	}
+	return "Bearer " + a.accessToken, nil
+}
+
+// Forgets the current access token so the next request gets a new one
+func (a *authenticator) invalidate() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.accessToken = ""
+}
+
+// Exchanges a UAA refresh token for an access token.  Doing it twice does no
+// harm, so it's retried like a GET.
+func (a *authenticator) exchange(refreshToken string) (accessToken string, expires time.Time, errRet error) {
+	endpointUrl := a.client.url("/api/v2/authentication/access_tokens")
+	postData, err := json.Marshal(map[string]string{"refresh_token": refreshToken})
+	if err != nil {
+		errRet = err
+		return
+	}
+	resp, err := httplib.DefaultRetryPolicy.Do("exchange refresh token", func() (*http.Response, error) {
+		req, err := http.NewRequest("POST", endpointUrl, bytes.NewReader(postData))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", a.client.userAgent)
+		return a.transport.Do(req)
+	})
+	if err != nil {
+		errRet = errors.New(fmt.Sprintf("can't exchange the Pivnet refresh token for an access token: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// UAA says why, e.g. that the refresh token has expired
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		errRet = errors.New(fmt.Sprintf("can't exchange the Pivnet refresh token for an access token ('Status: %v'): %v", resp.Status, strings.TrimSpace(string(body))))
+		return
+	}
+	var reply struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		errRet = err
+		return
+	}
+	if reply.AccessToken == "" {
+		errRet = errors.New("Pivnet returned no access token for the refresh token")
+		return
+	}
+	accessToken = reply.AccessToken
+	var ok bool
+	if expires, ok = jwtExpiry(accessToken); !ok {
+		expires = time.Now().Add(defaultAccessTokenLifetime)
+	}
+	return
+}
+
+// The exp claim of a JWT, which UAA access tokens are
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// Sends a request again with a new access token if Pivnet rejects the one it
+// had, which happens when a token is revoked or expires early
+type reauthTransport struct {
+	Transport httplib.Transport
+	auth      *authenticator
+}
+
+func (t *reauthTransport) Do(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, err
+	}
+
+	t.auth.invalidate()
+	authorization, err := t.auth.header()
+	if err != nil {
+		return resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	retry.Header.Set("Authorization", authorization)
+	resp.Body.Close()
+	return t.Transport.Do(retry)
+}
@@ -0,0 +1,180 @@
+package pivnetlib
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRefreshToken = "uaa-refresh-token-0123456789"
+
+// An unsigned JWT that expires at exp (or never says, for 0)
+func testJwt(exp time.Time, id int) string {
+	claims := map[string]interface{}{"jti": fmt.Sprintf("access-%v", id)}
+	if !exp.IsZero() {
+		claims["exp"] = exp.Unix()
+	}
+	payload, _ := json.Marshal(claims)
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+// Pivnet's access token exchange and authentication check
+type fakeUaa struct {
+	*httptest.Server
+	Lifetime time.Duration // of the access tokens handed out
+
+	mutex     sync.Mutex
+	exchanges int
+	current   string // the access token Pivnet accepts
+	headers   []string
+}
+
+func newFakeUaa(t *testing.T) *fakeUaa {
+	f := &fakeUaa{Lifetime: time.Hour}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeUaa) serve(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch r.URL.Path {
+	case "/api/v2/authentication/access_tokens":
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.RefreshToken != testRefreshToken {
+			http.Error(w, `{"message":"refresh token expired"}`, http.StatusUnauthorized)
+			return
+		}
+		f.exchanges++
+		f.current = testJwt(time.Now().Add(f.Lifetime), f.exchanges)
+		fmt.Fprintf(w, `{"access_token":%q}`, f.current)
+
+	case "/api/v2/authentication":
+		authorization := r.Header.Get("Authorization")
+		f.headers = append(f.headers, authorization)
+		if authorization != "Bearer "+f.current && authorization != "Token legacy-token-012345" {
+			http.Error(w, `{"message":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"message":"ok"}`)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Has Pivnet stop accepting the current access token, as if it were revoked
+func (f *fakeUaa) Revoke() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.current = "revoked"
+}
+
+func (f *fakeUaa) client(token string) *Client {
+	return NewClient(ClientOptions{BaseUrl: f.URL, Tokens: StaticToken(token)})
+}
+
+func TestJwtExpiry(t *testing.T) {
+	exp := time.Unix(1800000000, 0)
+	for _, tc := range []struct {
+		token  string
+		want   time.Time
+		wantOk bool
+	}{
+		{testJwt(exp, 1), exp, true},
+		{testJwt(time.Time{}, 1), time.Time{}, false},
+		{strings.TrimSuffix(testJwt(exp, 1), ".sig"), time.Time{}, false},
+		{"a.!!!.c", time.Time{}, false},
+		{"a." + base64.RawURLEncoding.EncodeToString([]byte("not json")) + ".c", time.Time{}, false},
+		{"legacy-token-012345", time.Time{}, false},
+	} {
+		got, ok := jwtExpiry(tc.token)
+		if ok != tc.wantOk || !got.Equal(tc.want) {
+			t.Errorf("%v: got %v, %v, want %v, %v", tc.token, got, ok, tc.want, tc.wantOk)
+		}
+	}
+}
+
+func TestRefreshTokenExchange(t *testing.T) {
+	f := newFakeUaa(t)
+	c := f.client(testRefreshToken)
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := c.VerifyAuthentication(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.exchanges != 1 {
+		t.Errorf("got %v exchanges for three requests, want 1", f.exchanges)
+	}
+	for _, authorization := range f.headers {
+		if authorization != "Bearer "+f.current {
+			t.Errorf("got Authorization %q, want the access token", authorization)
+		}
+	}
+}
+
+func TestRefreshTokenExpired(t *testing.T) {
+	f := newFakeUaa(t)
+	f.Lifetime = accessTokenMargin / 2 // already due to be replaced
+	c := f.client(testRefreshToken)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.VerifyAuthentication(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.exchanges != 2 {
+		t.Errorf("got %v exchanges for two requests with an expiring token, want 2", f.exchanges)
+	}
+}
+
+func TestReauthOn401(t *testing.T) {
+	f := newFakeUaa(t)
+	c := f.client(testRefreshToken)
+	if _, _, err := c.VerifyAuthentication(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Revoke()
+	if _, _, err := c.VerifyAuthentication(); err != nil {
+		t.Fatalf("got %v after the access token was revoked, want a retry with a new one", err)
+	}
+	if f.exchanges != 2 {
+		t.Errorf("got %v exchanges, want 2", f.exchanges)
+	}
+	if len(f.headers) != 3 || f.headers[1] != f.headers[0] || f.headers[2] != "Bearer "+f.current {
+		t.Errorf("got Authorization headers %q, want the 401 retried with a new token", f.headers)
+	}
+}
+
+func TestLegacyToken(t *testing.T) {
+	f := newFakeUaa(t)
+	if _, _, err := f.client("legacy-token-012345").VerifyAuthentication(); err != nil {
+		t.Fatal(err)
+	}
+	if f.exchanges != 0 || len(f.headers) != 1 || f.headers[0] != "Token legacy-token-012345" {
+		t.Errorf("got %v exchanges, Authorization %q", f.exchanges, f.headers)
+	}
+}
+
+func TestRefreshTokenRejected(t *testing.T) {
+	f := newFakeUaa(t)
+	_, _, err := f.client("uaa-refresh-token-expired-000").VerifyAuthentication()
+	if err == nil || !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "refresh token expired") {
+		t.Errorf("got error %v, want one with UAA's reason", err)
+	}
+	if len(f.headers) != 0 {
+		t.Errorf("got %v requests without an access token", len(f.headers))
+	}
+}
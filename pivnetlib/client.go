@@ -0,0 +1,105 @@
+package pivnetlib
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mgoelzer/stemcells/httplib"
+)
+
+const (
+	DefaultBaseUrl       = "https://network.pivotal.io"
+	DefaultTokenFilePath = "/home/ubuntu/.pivnet_token"
+	DefaultUserAgent     = "stemcells"
+)
+
+// Where a Client's debug output goes.  *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// How to reach Pivnet.  The zero value talks to network.pivotal.io with the
+// token from DefaultTokens.
+type ClientOptions struct {
+	BaseUrl    string            // "" for DefaultBaseUrl, e.g. staging or a fake server
+	Tokens     TokenSource       // nil for DefaultTokens()
+	HttpClient httplib.Transport // nil for httplib.NewClient()
+	Logger     Logger            // nil for no debug output
+	UserAgent  string            // "" for DefaultUserAgent
+}
+
+// What a command line says about Pivnet: the --pivnet-url, --token,
+// --token-file and --debug flags, and which program is asking
+type Settings struct {
+	BaseUrl   string
+	Token     string
+	TokenFile string
+	Debug     bool   // log requests and replies to stderr
+	Program   string // e.g. "stemcell/0.1.0", for the User-Agent
+}
+
+// A Client set up from s, sending requests through httpClient
+func NewClientFromSettings(s Settings, httpClient httplib.Transport) *Client {
+	opts := ClientOptions{
+		BaseUrl:    s.BaseUrl,
+		Tokens:     TokensFromFlags(s.Token, s.TokenFile),
+		HttpClient: httpClient,
+		UserAgent:  DefaultUserAgent,
+	}
+	if s.Program != "" {
+		opts.UserAgent += " " + s.Program
+	}
+	if s.Debug {
+		opts.Logger = log.New(os.Stderr, "pivnet: ", log.LstdFlags)
+	}
+	return NewClient(opts)
+}
+
+// Talks to the Pivnet API as one account.  Requests that are safe to repeat
+// are retried per httplib.DefaultRetryPolicy.
+type Client struct {
+	baseUrl   string
+	auth      *authenticator
+	transport httplib.Transport
+	logger    Logger
+	userAgent string
+}
+
+func NewClient(opts ClientOptions) *Client {
+	c := &Client{
+		baseUrl:   strings.TrimRight(opts.BaseUrl, "/"),
+		logger:    opts.Logger,
+		userAgent: opts.UserAgent,
+	}
+	if c.baseUrl == "" {
+		c.baseUrl = DefaultBaseUrl
+	}
+	tokens := opts.Tokens
+	if tokens == nil {
+		tokens = DefaultTokens()
+	}
+	httpClient := opts.HttpClient
+	if httpClient == nil {
+		httpClient = httplib.NewClient()
+	}
+	if c.userAgent == "" {
+		c.userAgent = DefaultUserAgent
+	}
+	retrying := &httplib.RetryTransport{Transport: httpClient}
+	c.auth = &authenticator{client: c, tokens: tokens, transport: retrying}
+	c.transport = &reauthTransport{Transport: retrying, auth: c.auth}
+	return c
+}
+
+// The URL of an API path such as "/api/v2/authentication"
+func (c *Client) url(format string, a ...interface{}) string {
+	return c.baseUrl + fmt.Sprintf(format, a...)
+}
+
+func (c *Client) logf(format string, v ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format, v...)
+	}
+}
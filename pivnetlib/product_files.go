@@ -2,29 +2,15 @@ package pivnetlib
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/golang-basic/go-curl"
+	"net/http"
 	"time"
 )
 
-func CreateProductFile(productSlug string, pivnetHumanFilename string, awsObjectKey string, description string, md5String string, version string, docsUrl string, release_date time.Time) (productFileId int, responseHeaders string, responseBodyJsonObj interface{}, errRet error) {
-	// Read the pivnet token
-	pivnetToken, err := getPivNetToken()
-	if err != nil {
-		return -1, "", "", err
-	}
-
-	easy := curl.EasyInit()
-	defer easy.Cleanup()
-
+func (c *Client) CreateProductFile(productSlug string, pivnetHumanFilename string, awsObjectKey string, description string, md5String string, version string, docsUrl string, release_date time.Time) (productFileId int, responseHeaders string, responseBodyJsonObj interface{}, errRet error) {
 	// set the url
-	endpointUrl := fmt.Sprintf("%v/api/v2/products/%v/product_files", urlPrefix, productSlug)
-	easy.Setopt(curl.OPT_URL, endpointUrl)
-	easy.Setopt(curl.OPT_VERBOSE, false)
-	//fmt.Printf("DEBUG:  endpointUrl='%v'\n", endpointUrl)
-
-	// set the pivnet headers
-	addPivNetHttpHeaders(easy, pivnetToken)
+	endpointUrl := c.url("/api/v2/products/%v/product_files", productSlug)
 
 	m := &ProductFile{
 		ProductFileInner: ProductFileInner{
@@ -40,57 +26,68 @@ func CreateProductFile(productSlug string, pivnetHumanFilename string, awsObject
 		},
 	}
 	postData, err := json.MarshalIndent(m, "", "    ")
-	//fmt.Printf("\n---POST DATA---\n%s\n---------------\n", postData)
-	easy.Setopt(curl.OPT_POST, true)
-	easy.Setopt(curl.OPT_POSTFIELDSIZE, len(postData))
-	sent := false
-	fReadRequest := func(ptr []byte, userdata interface{}) int {
-		if !sent {
-			sent = true
-			ret := copy(ptr, postData)
-			return ret
-		}
-		return 0
-	}
-	easy.Setopt(curl.OPT_READFUNCTION, fReadRequest)
-
-	// set function to collect response data into string buffer
-	response := ""
-	fWriteToString := func(buf []byte, userdata interface{}) bool {
-		if bDebug {
-			fmt.Printf("CreateProductFile response> %s", string(buf))
-		}
-		response += string(buf)
-		return true
+	if err != nil {
+		errRet = err
+		return
 	}
-	easy.Setopt(curl.OPT_WRITEFUNCTION, fWriteToString)
+	c.logf("\n---POST DATA---\n%s\n---------------\n", postData)
 
-	// invoke curl
-	if err := easy.Perform(); err != nil {
-		fmt.Printf("curl failed\n")
+	// send the request; a retry first checks the file wasn't made anyway
+	resp, existingId, err := c.postWithRetry(fmt.Sprintf("create product file %v", awsObjectKey),
+		func() (*http.Request, error) {
+			return c.newRequest("POST", endpointUrl, postData)
+		},
+		func() (int, error) {
+			return c.findProductFileId(productSlug, awsObjectKey)
+		})
+	if err != nil {
+		c.logf("request failed\n")
 		errRet = err
 		return
 	}
+	if existingId > 0 {
+		productFileId = existingId
+		return
+	}
 
 	// check the http response status
-	statusCodeMsg, responseHeaders, responseBodyJsonObj, err := checkHttpResponse(response)
+	statusCodeMsg, responseHeaders, responseBodyJsonObj, err := c.checkHttpResponse(resp)
 	if err != nil {
-		fmt.Printf("Error:  checkHttpResponse returned err=%v\n", err)
+		c.logf("Error:  checkHttpResponse returned err=%v\n", err)
 		errRet = err
 		return
 	} else {
-		fmt.Printf(">>>>statusCodeMsg='%v'\n", statusCodeMsg)
-		m := responseBodyJsonObj.(map[string]interface{})
-		//fmt.Printf("***m = '%v'\n", m)
-		mProductFile := m["product_file"].(map[string]interface{})
-		//fmt.Printf("***mProductFile = '%v'\n", mProductFile)
-		idFloat64 := mProductFile["id"].(float64)
-		productFileId = int(idFloat64)
-		//fmt.Printf("productFileId = '%v'\n", productFileId)
-		//fmt.Printf("idFloat64 = '%v'\n", idFloat64)
-		if bDebug {
-			fmt.Printf("CreateProductFile success:  %v\n", statusCodeMsg)
+		var created struct {
+			ProductFile struct {
+				Id int `json:"id"`
+			} `json:"product_file"`
+		}
+		if err := decodeReply(responseBodyJsonObj, &created); err != nil || created.ProductFile.Id <= 0 {
+			errRet = errors.New(fmt.Sprintf("can't find the id of product file %v in Pivnet's reply '%v'", awsObjectKey, responseBodyJsonObj))
+			return
 		}
+		productFileId = created.ProductFile.Id
+		c.logf("CreateProductFile success:  %v\n", statusCodeMsg)
 		return
 	}
 }
+
+// Id of the product file for an S3 object key, or 0 if there isn't one
+func (c *Client) findProductFileId(productSlug string, awsObjectKey string) (int, error) {
+	var productFiles struct {
+		ProductFiles []struct {
+			Id           int    `json:"id"`
+			AwsObjectKey string `json:"aws_object_key"`
+		} `json:"product_files"`
+	}
+	endpointUrl := c.url("/api/v2/products/%v/product_files", productSlug)
+	if err := c.getJson(endpointUrl, &productFiles); err != nil {
+		return 0, err
+	}
+	for _, productFile := range productFiles.ProductFiles {
+		if productFile.AwsObjectKey == awsObjectKey {
+			return productFile.Id, nil
+		}
+	}
+	return 0, nil
+}
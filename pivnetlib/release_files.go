@@ -0,0 +1,54 @@
+package pivnetlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mgoelzer/stemcells/httplib"
+)
+
+// Body of the add_product_file and remove_product_file endpoints
+type productFileRef struct {
+	ProductFile struct {
+		Id int `json:"id"`
+	} `json:"product_file"`
+}
+
+// Attaches an existing product file to a release
+func (c *Client) AddProductFileToRelease(productSlug string, releaseId int, productFileId int) error {
+	return c.patchReleaseProductFile(productSlug, releaseId, productFileId, "add_product_file")
+}
+
+// Detaches a product file from a release (the product file itself stays)
+func (c *Client) RemoveProductFileFromRelease(productSlug string, releaseId int, productFileId int) error {
+	return c.patchReleaseProductFile(productSlug, releaseId, productFileId, "remove_product_file")
+}
+
+func (c *Client) patchReleaseProductFile(productSlug string, releaseId int, productFileId int, action string) error {
+	endpointUrl := c.url("/api/v2/products/%v/releases/%v/%v", productSlug, releaseId, action)
+	var ref productFileRef
+	ref.ProductFile.Id = productFileId
+	postData, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	// Adding a file that's already there (or removing one that's gone) leaves
+	// the release the same, so the PATCH is safe to retry
+	resp, err := httplib.DefaultRetryPolicy.Do(fmt.Sprintf("%v %v", action, productFileId), func() (*http.Response, error) {
+		req, err := c.newRequest("PATCH", endpointUrl, postData)
+		if err != nil {
+			return nil, err
+		}
+		return c.transport.Do(req)
+	})
+	if err != nil {
+		return err
+	}
+	statusCodeMsg, _, _, err := c.checkHttpResponse(resp)
+	if err != nil {
+		return err
+	}
+	c.logf("%v success:  %v\n", action, statusCodeMsg)
+	return nil
+}
@@ -0,0 +1,163 @@
+package pivnetlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mgoelzer/stemcells/httplib"
+)
+
+// Just enough of the Pivnet releases API to find and create releases and
+// product files and change which files a release has
+type fakePivnet struct {
+	*httptest.Server
+	Releases     map[int]string // release id -> version
+	FailFirst    bool           // answer the first create with a 502...
+	CreatedFirst bool           // ...after creating it anyway
+	BadReply     string         // answer creates with this instead
+
+	mutex    sync.Mutex
+	posts    int
+	requests []string // method, path and body of every request
+}
+
+func newFakePivnet(t *testing.T) *fakePivnet {
+	f := &fakePivnet{Releases: map[int]string{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+
+	// Retries right away
+	saved := httplib.DefaultRetryPolicy
+	httplib.DefaultRetryPolicy = &httplib.RetryPolicy{MaxAttempts: 3, Logf: t.Logf}
+	t.Cleanup(func() { httplib.DefaultRetryPolicy = saved })
+	return f
+}
+
+// A Client of the fake
+func (f *fakePivnet) Client() *Client {
+	return NewClient(ClientOptions{BaseUrl: f.URL, Tokens: StaticToken("test-token")})
+}
+
+func (f *fakePivnet) serve(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r.Header.Get("Authorization") != "Token test-token" {
+		http.Error(w, `{"message":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	f.requests = append(f.requests, strings.TrimSpace(fmt.Sprintf("%v %v %s", r.Method, r.URL.Path, body)))
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/v2/products/stemcells/releases":
+		var releases struct {
+			Releases []map[string]interface{} `json:"releases"`
+		}
+		for id, version := range f.Releases {
+			releases.Releases = append(releases.Releases, map[string]interface{}{"id": id, "version": version})
+		}
+		json.NewEncoder(w).Encode(releases)
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/v2/products/stemcells/releases/"):
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/v2/products/stemcells/releases/"))
+		version, ok := f.Releases[id]
+		if !ok {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"id":%v,"version":%q,"product_files":[]}`, id, version)
+
+	case r.Method == "POST" && r.URL.Path == "/api/v2/products/stemcells/releases":
+		var release Release
+		if err := json.Unmarshal(body, &release); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.posts++
+		id := 40 + f.posts
+		if f.FailFirst && f.posts == 1 {
+			if f.CreatedFirst {
+				f.Releases[id] = release.ReleaseInner.Version
+			}
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		if f.BadReply != "" {
+			fmt.Fprint(w, f.BadReply)
+			return
+		}
+		f.Releases[id] = release.ReleaseInner.Version
+		fmt.Fprintf(w, `{"release":{"id":%v,"version":%q}}`, id, release.ReleaseInner.Version)
+
+	case r.Method == "GET" && r.URL.Path == "/api/v2/products/stemcells/product_files":
+		fmt.Fprint(w, `{"product_files":[]}`)
+
+	case r.Method == "POST" && r.URL.Path == "/api/v2/products/stemcells/product_files":
+		f.posts++
+		w.WriteHeader(http.StatusCreated)
+		if f.BadReply != "" {
+			fmt.Fprint(w, f.BadReply)
+			return
+		}
+		fmt.Fprint(w, `{"product_file":{"id":12345}}`)
+
+	case r.Method == "PATCH" && strings.HasPrefix(r.URL.Path, "/api/v2/products/stemcells/releases/557/"):
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+	}
+}
+
+func (f *fakePivnet) Requests() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+func TestReleaseProductFiles(t *testing.T) {
+	f := newFakePivnet(t)
+	c := f.Client()
+
+	if err := c.AddProductFileToRelease("stemcells", 557, 12345); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveProductFileFromRelease("stemcells", 557, 12346); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddProductFileToRelease("stemcells", 558, 12345); err == nil {
+		t.Errorf("got no error adding to a release that doesn't exist")
+	}
+
+	want := []string{
+		`PATCH /api/v2/products/stemcells/releases/557/add_product_file {"product_file":{"id":12345}}`,
+		`PATCH /api/v2/products/stemcells/releases/557/remove_product_file {"product_file":{"id":12346}}`,
+		`PATCH /api/v2/products/stemcells/releases/558/add_product_file {"product_file":{"id":12345}}`,
+	}
+	if got := f.Requests(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFindReleaseByVersion(t *testing.T) {
+	f := newFakePivnet(t)
+	f.Releases[557] = "3026"
+	f.Releases[558] = "3026.1"
+
+	for version, want := range map[string]int{"3026": 557, "3026.1": 558} {
+		if release, err := f.Client().FindReleaseByVersion("stemcells", version); err != nil || release.Id != want {
+			t.Errorf("%v: got %v, %v, want %v", version, release, err, want)
+		}
+	}
+	if release, err := f.Client().FindReleaseByVersion("stemcells", "3027"); err == nil || !strings.Contains(err.Error(), "no release 3027") {
+		t.Errorf("3027: got %v, %v, want an error saying there's no release", release, err)
+	}
+}
@@ -1,40 +1,23 @@
 package pivnetlib
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/golang-basic/go-curl"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func CreateRelease(productSlug string, version string, description string) (releaseId int, responseHeaders string, responseBodyJsonObj interface{}, errRet error) {
-	// Read the pivnet token
-	pivnetToken, err := getPivNetToken()
-	if err != nil {
-		errRet = err
-		return
-	}
-
-	easy := curl.EasyInit()
-	defer easy.Cleanup()
-
+func (c *Client) CreateRelease(productSlug string, version string, description string) (releaseId int, responseHeaders string, responseBodyJsonObj interface{}, errRet error) {
 	// set the url
-	endpointUrl := fmt.Sprintf("%v/api/v2/products/%v/releases", urlPrefix, productSlug)
-	easy.Setopt(curl.OPT_URL, endpointUrl)
-	easy.Setopt(curl.OPT_VERBOSE, false)
-	//fmt.Printf("DEBUG:  endpointUrl='%v'\n", endpointUrl)
-
-	// set the pivnet headers
-	addPivNetHttpHeaders(easy, pivnetToken)
+	endpointUrl := c.url("/api/v2/products/%v/releases", productSlug)
 
 	// get the post data
 	t := time.Now()
 	tPlusThreeYears := t.AddDate(3, 0, 0)
 
-	//postData := getCreateReleasePostData("1000", "", t, tPlusThreeYears, tPlusThreeYears, tPlusThreeYears)
-
 	r := &Release{
 		ReleaseInner: ReleaseInner{
 			Version:               version,
@@ -54,83 +37,174 @@ func CreateRelease(productSlug string, version string, description string) (rele
 		},
 	}
 	postData, err := json.MarshalIndent(r, "", "    ")
-	fmt.Printf("\n---POST DATA---\n%s\n---------------\n", postData)
-	easy.Setopt(curl.OPT_POST, true)
-	easy.Setopt(curl.OPT_POSTFIELDSIZE, len(postData))
-	sent := false
-	fReadRequest := func(ptr []byte, userdata interface{}) int {
-		if !sent {
-			sent = true
-			ret := copy(ptr, postData)
-			return ret
-		}
-		return 0
-	}
-	easy.Setopt(curl.OPT_READFUNCTION, fReadRequest)
-
-	// set function to collect response data into string buffer
-	response := ""
-	fWriteToString := func(buf []byte, userdata interface{}) bool {
-		if bDebug {
-			fmt.Printf("CreateRelease response> %s", string(buf))
-		}
-		response += string(buf)
-		return true
+	if err != nil {
+		errRet = err
+		return
 	}
-	easy.Setopt(curl.OPT_WRITEFUNCTION, fWriteToString)
+	c.logf("\n---POST DATA---\n%s\n---------------\n", postData)
 
-	// invoke curl
-	if err := easy.Perform(); err != nil {
-		fmt.Printf("curl failed\n")
+	// send the request; a retry first checks the release wasn't made anyway
+	resp, existingId, err := c.postWithRetry(fmt.Sprintf("create release %v", version),
+		func() (*http.Request, error) {
+			return c.newRequest("POST", endpointUrl, postData)
+		},
+		func() (int, error) {
+			return c.findReleaseId(productSlug, version)
+		})
+	if err != nil {
+		c.logf("request failed\n")
 		errRet = err
 		return
 	}
+	if existingId > 0 {
+		releaseId = existingId
+		return
+	}
 
 	// check the http response status
-	statusCodeMsg, responseHeaders, responseBodyJsonObj, err := checkHttpResponse(response)
+	statusCodeMsg, responseHeaders, responseBodyJsonObj, err := c.checkHttpResponse(resp)
 	if err != nil {
 		errRet = err
 		return
 	} else {
-		m := responseBodyJsonObj.(map[string]interface{})
-		mRelease := m["release"].(map[string]interface{})
-		//fmt.Printf("***mRelease = '%v'\n", mRelease)
-		idFloat64 := mRelease["id"].(float64)
-		releaseId = int(idFloat64)
-		//fmt.Printf("releaseId = '%v'\n", releaseId)
-		//fmt.Printf("idFloat64 = '%v'\n", idFloat64)
-		if bDebug {
-			fmt.Printf("CreateRelease success:  %v\n", statusCodeMsg)
+		var created struct {
+			Release struct {
+				Id int `json:"id"`
+			} `json:"release"`
+		}
+		if err := decodeReply(responseBodyJsonObj, &created); err != nil || created.Release.Id <= 0 {
+			errRet = errors.New(fmt.Sprintf("can't find the id of release %v in Pivnet's reply '%v'", version, responseBodyJsonObj))
+			return
 		}
+		releaseId = created.Release.Id
+		c.logf("CreateRelease success:  %v\n", statusCodeMsg)
 		return
 	}
 
 }
 
-func DeleteRelease(productSlug string, releaseId int) error {
-	// Read the pivnet token
-	pivnetToken, err := getPivNetToken()
+// Every release of a product, as Pivnet lists them (newest first)
+func (c *Client) ListReleases(productSlug string) ([]ReleaseInfo, error) {
+	var releases struct {
+		Releases []ReleaseInfo `json:"releases"`
+	}
+	endpointUrl := c.url("/api/v2/products/%v/releases", productSlug)
+	if err := c.getJson(endpointUrl, &releases); err != nil {
+		return nil, err
+	}
+	return releases.Releases, nil
+}
+
+// One release, with its product files
+func (c *Client) GetRelease(productSlug string, releaseId int) (*ReleaseInfo, error) {
+	var release ReleaseInfo
+	endpointUrl := c.url("/api/v2/products/%v/releases/%v", productSlug, releaseId)
+	if err := c.getJson(endpointUrl, &release); err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// The release of a product with the given version, or an error if there isn't
+// one
+func (c *Client) FindReleaseByVersion(productSlug string, version string) (*ReleaseInfo, error) {
+	releases, err := c.ListReleases(productSlug)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if release := releaseWithVersion(releases, version); release != nil {
+		return release, nil
+	}
+	return nil, errors.New(fmt.Sprintf("%v has no release %v", productSlug, version))
+}
+
+func releaseWithVersion(releases []ReleaseInfo, version string) *ReleaseInfo {
+	for i, release := range releases {
+		if release.Version == version {
+			return &releases[i]
+		}
+	}
+	return nil
+}
+
+// Finds a release from what someone typed: "id:557" or "version:3026" say
+// which they mean; a bare "3026" can be either, as long as it doesn't match
+// one release by id and another by version.  An id is looked up on its own,
+// so the whole list is only fetched for a version or to rule out a clash.
+func (c *Client) ResolveRelease(productSlug string, arg string) (*ReleaseInfo, error) {
+	byId, byVersion := true, true
+	switch {
+	case strings.HasPrefix(arg, "id:"):
+		arg, byVersion = strings.TrimPrefix(arg, "id:"), false
+	case strings.HasPrefix(arg, "version:"):
+		arg, byId = strings.TrimPrefix(arg, "version:"), false
+	}
+	releaseId, err := strconv.Atoi(arg)
+	if err != nil || releaseId <= 0 {
+		byId = false
+	}
+	if strings.TrimSpace(arg) == "" || strings.ContainsAny(arg, " \t/") {
+		byVersion = false
+	}
+	if !byId && !byVersion {
+		return nil, errors.New(fmt.Sprintf("'%v' is neither a release id nor a version", arg))
+	}
+
+	var idMatch *ReleaseInfo
+	if byId {
+		idMatch, err = c.GetRelease(productSlug, releaseId)
+		if _, notFound := err.(*notFoundError); err != nil && !notFound {
+			return nil, err
+		}
+		// Nothing else can have this version, so there's no clash to look for
+		if idMatch != nil && (!byVersion || idMatch.Version == arg) {
+			return idMatch, nil
+		}
+	}
+
+	var versionMatch *ReleaseInfo
+	if byVersion {
+		releases, err := c.ListReleases(productSlug)
+		if err != nil {
+			return nil, err
+		}
+		versionMatch = releaseWithVersion(releases, arg)
+	}
+	switch {
+	case idMatch != nil && versionMatch != nil && idMatch.Id != versionMatch.Id:
+		return nil, errors.New(fmt.Sprintf("'%v' is both the id of one release (version %v) and the version of another (id %v); say id:%v or version:%v", arg, idMatch.Version, versionMatch.Id, arg, arg))
+	case versionMatch != nil:
+		return versionMatch, nil
+	case idMatch != nil:
+		return idMatch, nil
+	}
+	return nil, errors.New(fmt.Sprintf("%v has no release '%v'", productSlug, arg))
+}
 
-	// Curl does not support DELETE, so we do it the old fashioned way
-	client := &http.Client{}
-	endpointUrl := fmt.Sprintf("%v/api/v2/products/%v/releases/%v", urlPrefix, productSlug, releaseId)
-	b := bytes.NewBufferString("")
-	req, err := http.NewRequest("DELETE", endpointUrl, b)
+// Id of the release of a product with the given version, or 0 if there isn't
+// one
+func (c *Client) findReleaseId(productSlug string, version string) (int, error) {
+	releases, err := c.ListReleases(productSlug)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if release := releaseWithVersion(releases, version); release != nil {
+		return release.Id, nil
 	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Token "+pivnetToken)
-	reply, err := client.Do(req)
+	return 0, nil
+}
+
+func (c *Client) DeleteRelease(productSlug string, releaseId int) error {
+	endpointUrl := c.url("/api/v2/products/%v/releases/%v", productSlug, releaseId)
+	req, err := c.newRequest("DELETE", endpointUrl, nil)
 	if err != nil {
 		return err
 	}
-	if bDebug {
-		fmt.Printf("reply='%v'\n", reply)
+	reply, err := c.transport.Do(req)
+	if err != nil {
+		return err
 	}
-	return nil
+	c.logf("reply='%v'\n", reply)
+	_, _, _, err = c.checkHttpResponse(reply)
+	return err
 }
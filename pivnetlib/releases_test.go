@@ -0,0 +1,122 @@
+package pivnetlib
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateReleaseDoesntDuplicate(t *testing.T) {
+	for _, tc := range []struct {
+		createdFirst bool
+		wantId       int
+		wantPosts    int
+	}{
+		{true, 41, 1},  // the first POST went through, so it isn't sent again
+		{false, 42, 2}, // it didn't, so it is
+	} {
+		f := newFakePivnet(t)
+		f.FailFirst = true
+		f.CreatedFirst = tc.createdFirst
+
+		releaseId, _, _, err := f.Client().CreateRelease("stemcells", "3026", "BOSH stemcells")
+		if err != nil {
+			t.Errorf("created first %v: %v", tc.createdFirst, err)
+			continue
+		}
+		if releaseId != tc.wantId || f.posts != tc.wantPosts || len(f.Releases) != 1 {
+			t.Errorf("created first %v: got release %v after %v POSTs, %v releases", tc.createdFirst, releaseId, f.posts, len(f.Releases))
+		}
+	}
+}
+
+func TestCreateReleaseBadReply(t *testing.T) {
+	for _, reply := range []string{
+		`{}`,
+		`{"release":"3026"}`,
+		`{"release":{"id":"41"}}`,
+		`{"release":{"version":"3026"}}`,
+		`[]`,
+	} {
+		f := newFakePivnet(t)
+		f.BadReply = reply
+
+		releaseId, _, _, err := f.Client().CreateRelease("stemcells", "3026", "BOSH stemcells")
+		if err == nil || !strings.Contains(err.Error(), "can't find the id of release 3026") {
+			t.Errorf("%v: got release %v, error %v", reply, releaseId, err)
+		}
+	}
+}
+
+func TestCreateProductFile(t *testing.T) {
+	f := newFakePivnet(t)
+	c := f.Client()
+	productFileId, _, _, err := c.CreateProductFile("stemcells", "vSphere", "product_files/stemcell.tgz", "", "0123", "3026", "", time.Now())
+	if err != nil || productFileId != 12345 {
+		t.Errorf("got product file %v, error %v", productFileId, err)
+	}
+
+	f.BadReply = `{"product_file":{"id":null}}`
+	productFileId, _, _, err = c.CreateProductFile("stemcells", "vSphere", "product_files/stemcell.tgz", "", "0123", "3026", "", time.Now())
+	if err == nil || !strings.Contains(err.Error(), "can't find the id of product file") {
+		t.Errorf("bad reply: got product file %v, error %v", productFileId, err)
+	}
+}
+
+func TestResolveRelease(t *testing.T) {
+	f := newFakePivnet(t)
+	f.Releases[557] = "3026"
+	f.Releases[558] = "3026.1"
+	f.Releases[3026] = "2989" // an id that looks like another release's version
+	f.Releases[600] = "600"   // its own id and version
+
+	for _, tc := range []struct {
+		arg       string
+		want      int
+		wantLists int // times the whole list is fetched
+	}{
+		{"557", 557, 1},    // not a version, but has to be ruled out as one
+		{"id:557", 557, 0}, // looked up on its own
+		{"600", 600, 0},    // the id and version agree
+		{"3026.1", 558, 1}, // only a version
+		{"version:3026.1", 558, 1},
+		{"2989", 3026, 1}, // only a version, though it could be an id
+		{"id:3026", 3026, 0},
+		{"version:3026", 557, 1},
+	} {
+		before := len(f.Requests())
+		release, err := f.Client().ResolveRelease("stemcells", tc.arg)
+		if err != nil {
+			t.Errorf("%v: %v", tc.arg, err)
+			continue
+		}
+		if release.Id != tc.want {
+			t.Errorf("%v: got release %v, want %v", tc.arg, release.Id, tc.want)
+		}
+		lists := 0
+		for _, request := range f.Requests()[before:] {
+			if request == "GET /api/v2/products/stemcells/releases" {
+				lists++
+			}
+		}
+		if lists != tc.wantLists {
+			t.Errorf("%v: listed releases %v times, want %v", tc.arg, lists, tc.wantLists)
+		}
+	}
+
+	for _, tc := range []struct {
+		arg  string
+		want string
+	}{
+		{"3026", "is both the id of one release (version 2989) and the version of another (id 557)"},
+		{"3027", "has no release '3027'"},
+		{"id:3026.1", "is neither a release id nor a version"},
+		{"version:", "is neither a release id nor a version"},
+		{"id:999", "has no release '999'"},
+	} {
+		release, err := f.Client().ResolveRelease("stemcells", tc.arg)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: got %v, %v, want an error saying %q", tc.arg, release, err, tc.want)
+		}
+	}
+}
@@ -3,15 +3,309 @@ package pivnetlib
 // Must install Amazon Go SDK:  go get -u github.com/aws/aws-sdk-go/...
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
 
-	//	"github.com/aws/aws-sdk-go/aws"
-	//	"github.com/aws/aws-sdk-go/aws/awserr"
-	//	"github.com/aws/aws-sdk-go/aws/awsutil"
-	//	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/mgoelzer/stemcells/httplib"
+)
+
+// Where product files are uploaded to before Pivnet is told about them
+const DefaultS3Prefix = "product_files/Pivotal-CF/"
+
+const (
+	DefaultS3Region   = "us-east-1"
+	DefaultS3PartSize = 16 * 1024 * 1024
+	DefaultS3Parallel = 4
+
+	// S3's own limits on multipart uploads
+	s3MinPartSize = 5 * 1024 * 1024
+	s3MaxParts    = 10000
 )
 
-func S3Upload() error {
-	fmt.Println("hello")
+// Uploads files to the S3 bucket behind Pivnet product files, as multipart
+// uploads with several parts in flight at once.  Credentials come from the
+// usual AWS places ($AWS_ACCESS_KEY_ID/$AWS_SECRET_ACCESS_KEY,
+// ~/.aws/credentials, an instance role).
+type S3Uploader struct {
+	Bucket   string
+	Region   string // "" for DefaultS3Region
+	Endpoint string // "" for AWS itself; otherwise e.g. http://127.0.0.1:9000 for a local S3 stand-in
+	PartSize int64  // 0 for DefaultS3PartSize
+	Parallel int    // 0 for DefaultS3Parallel
+
+	Client      *http.Client         // nil for httplib.NewClient()
+	RateLimiter *httplib.RateLimiter // nil for httplib.DefaultRateLimiter
+	Retry       *httplib.RetryPolicy // nil for httplib.DefaultRetryPolicy
+}
+
+// One uploaded part, with the MD5 S3 has to agree with
+type s3Part struct {
+	number int64
+	offset int64
+	size   int64
+	md5    []byte
+}
+
+// Uploads localPath to objectKey, calling progress as parts finish.  Each
+// part is sent with its Content-MD5 and its ETag checked against it, and the
+// completed object's ETag is checked against the parts.  If anything fails the
+// multipart upload is aborted so no parts are left behind in the bucket, and
+// an object that doesn't match once completed is deleted.
+func (u *S3Uploader) Upload(localPath string, objectKey string, progress func(done, total int64)) (errRet error) {
+	if u.Bucket == "" {
+		return errors.New("no S3 bucket to upload to")
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := st.Size()
+	parts := u.splitParts(size)
+
+	svc, err := u.newS3()
+	if err != nil {
+		return err
+	}
+	created, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(u.Bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("can't start upload of s3://%v/%v: %v", u.Bucket, objectKey, err))
+	}
+	uploadId := created.UploadId
+	finished := false
+	defer func() {
+		if errRet != nil && !finished {
+			svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(u.Bucket),
+				Key:      aws.String(objectKey),
+				UploadId: uploadId,
+			})
+		}
+	}()
+
+	if progress != nil {
+		progress(0, size)
+	}
+	completed := make([]*s3.CompletedPart, len(parts))
+	var mutex sync.Mutex
+	var firstErr error
+	done := int64(0)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < u.parallel(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				mutex.Lock()
+				failed := firstErr != nil
+				mutex.Unlock()
+				if failed {
+					continue
+				}
+				etag, err := u.uploadPart(svc, f, objectKey, uploadId, &parts[i])
+				mutex.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					completed[i] = &s3.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int64(parts[i].number)}
+					done += parts[i].size
+					if progress != nil {
+						progress(done, size)
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := range parts {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	result, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.Bucket),
+		Key:             aws.String(objectKey),
+		UploadId:        uploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("can't complete upload of s3://%v/%v: %v", u.Bucket, objectKey, err))
+	}
+	finished = true
+	if etag := trimETag(aws.StringValue(result.ETag)); etag != "" && etag != multipartETag(parts) {
+		// There's no upload left to abort, but the object mustn't stay where
+		// Pivnet would serve it
+		_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(u.Bucket),
+			Key:    aws.String(objectKey),
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("s3://%v/%v has ETag %v, expected %v, and can't be deleted: %v", u.Bucket, objectKey, etag, multipartETag(parts), err))
+		}
+		return errors.New(fmt.Sprintf("s3://%v/%v has ETag %v, expected %v, so it was deleted", u.Bucket, objectKey, etag, multipartETag(parts)))
+	}
 	return nil
 }
+
+// Hashes one part, sends it and checks S3 got the same bytes
+func (u *S3Uploader) uploadPart(svc *s3.S3, f *os.File, objectKey string, uploadId *string, part *s3Part) (etag string, errRet error) {
+	body := io.NewSectionReader(f, part.offset, part.size)
+	h := md5.New()
+	if _, err := io.Copy(h, body); err != nil {
+		errRet = err
+		return
+	}
+	part.md5 = h.Sum(nil)
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		errRet = err
+		return
+	}
+
+	resp, err := svc.UploadPart(&s3.UploadPartInput{
+		Bucket:        aws.String(u.Bucket),
+		Key:           aws.String(objectKey),
+		UploadId:      uploadId,
+		PartNumber:    aws.Int64(part.number),
+		Body:          body,
+		ContentLength: aws.Int64(part.size),
+		ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(part.md5)),
+	})
+	if err != nil {
+		errRet = errors.New(fmt.Sprintf("upload of part %v failed: %v", part.number, err))
+		return
+	}
+	etag = aws.StringValue(resp.ETag)
+	if trimETag(etag) != hex.EncodeToString(part.md5) {
+		errRet = errors.New(fmt.Sprintf("part %v has ETag %v, expected %v", part.number, etag, hex.EncodeToString(part.md5)))
+		return
+	}
+	return
+}
+
+// Splits a file into parts of PartSize, bigger if there would be too many
+func (u *S3Uploader) splitParts(size int64) []s3Part {
+	partSize := u.PartSize
+	if partSize <= 0 {
+		partSize = DefaultS3PartSize
+	}
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+	for (size+partSize-1)/partSize > s3MaxParts {
+		partSize *= 2
+	}
+	parts := []s3Part{}
+	for offset := int64(0); offset < size || len(parts) == 0; offset += partSize {
+		n := partSize
+		if offset+n > size {
+			n = size - offset
+		}
+		parts = append(parts, s3Part{number: int64(len(parts) + 1), offset: offset, size: n})
+	}
+	return parts
+}
+
+func (u *S3Uploader) parallel() int {
+	if u.Parallel <= 0 {
+		return DefaultS3Parallel
+	}
+	return u.Parallel
+}
+
+func (u *S3Uploader) newS3() (*s3.S3, error) {
+	region := u.Region
+	if region == "" {
+		region = DefaultS3Region
+	}
+	client := u.Client
+	if client == nil {
+		client = httplib.NewClient()
+	}
+	limiter := u.RateLimiter
+	if limiter == nil {
+		limiter = httplib.DefaultRateLimiter
+	}
+	if limiter != nil {
+		limited := *client
+		limited.Transport = &rateLimitedTransport{Transport: client.Transport, Limiter: limiter}
+		client = &limited
+	}
+	cfg := &aws.Config{
+		Region:     aws.String(region),
+		HTTPClient: client,
+		MaxRetries: aws.Int(u.Retry.OrDefault().MaxAttempts - 1),
+	}
+	if u.Endpoint != "" {
+		// Stand-ins rarely do virtual-hosted buckets
+		cfg.Endpoint = aws.String(u.Endpoint)
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// The ETag S3 gives an object put together from these parts: the MD5 of
+// their MD5s, and how many there were
+func multipartETag(parts []s3Part) string {
+	h := md5.New()
+	for _, part := range parts {
+		h.Write(part.md5)
+	}
+	return fmt.Sprintf("%x-%v", h.Sum(nil), len(parts))
+}
+
+func trimETag(etag string) string {
+	return strings.ToLower(strings.Trim(etag, `"`))
+}
+
+// Paces request bodies through a rate limiter, so uploads share the limit
+// with downloads
+type rateLimitedTransport struct {
+	Transport http.RoundTripper
+	Limiter   *httplib.RateLimiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		limited := *req
+		limited.Body = struct {
+			io.Reader
+			io.Closer
+		}{t.Limiter.Reader(req.Body), req.Body}
+		req = &limited
+	}
+	return transport.RoundTrip(req)
+}
@@ -0,0 +1,258 @@
+package pivnetlib
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mgoelzer/stemcells/httplib"
+)
+
+// Just enough of S3's multipart upload API to upload through, with ways to
+// make it answer with the wrong ETags
+type fakeS3 struct {
+	*httptest.Server
+	BadPartETag  int  // part number to give a wrong ETag
+	BadFinalETag bool // give the completed object a wrong ETag
+
+	mutex   sync.Mutex
+	parts   map[int][]byte
+	objects map[string][]byte
+	aborted bool
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	s := &fakeS3{parts: map[int][]byte{}, objects: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	// No real credentials, and nowhere else for the SDK to look for them
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "none"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "none"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	return s
+}
+
+func (s *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	q := r.URL.Query()
+	switch {
+	case r.Method == "POST" && q.Has("uploads"):
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>b</Bucket><Key>k</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+
+	case r.Method == "PUT" && q.Get("uploadId") == "upload-1":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sum := md5.Sum(data)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			http.Error(w, "BadDigest", http.StatusBadRequest)
+			return
+		}
+		s.parts[n] = data
+		etag := hex.EncodeToString(sum[:])
+		if n == s.BadPartETag {
+			etag = strings.Repeat("0", 32)
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+
+	case r.Method == "POST" && q.Get("uploadId") == "upload-1":
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		sums := md5.New()
+		for i, part := range complete.Parts {
+			data, ok := s.parts[part.PartNumber]
+			if !ok || part.PartNumber != i+1 {
+				http.Error(w, "InvalidPart", http.StatusBadRequest)
+				return
+			}
+			sum := md5.Sum(data)
+			sums.Write(sum[:])
+			object = append(object, data...)
+		}
+		s.objects[r.URL.Path] = object
+		etag := fmt.Sprintf("%x-%v", sums.Sum(nil), len(complete.Parts))
+		if s.BadFinalETag {
+			etag = "0123-1"
+		}
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>"%v"</ETag></CompleteMultipartUploadResult>`, etag)
+
+	case r.Method == "DELETE" && q.Get("uploadId") == "upload-1":
+		s.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "DELETE" && len(q) == 0:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+// A file big enough for three minimum-size parts
+func testUploadFile(t *testing.T) (string, []byte) {
+	data := make([]byte, 2*s3MinPartSize+1234)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(t.TempDir(), "stemcell.tgz")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func testUploader(s *fakeS3) *S3Uploader {
+	return &S3Uploader{
+		Bucket:   "pivnet-bucket",
+		Endpoint: s.URL,
+		PartSize: s3MinPartSize,
+		Parallel: 2,
+		Client:   &http.Client{},
+		Retry:    &httplib.RetryPolicy{MaxAttempts: 1},
+	}
+}
+
+func TestS3Upload(t *testing.T) {
+	s := newFakeS3(t)
+	path, data := testUploadFile(t)
+	var mutex sync.Mutex
+	var reported []int64
+	progress := func(done, total int64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if total != int64(len(data)) {
+			t.Errorf("got total %v, want %v", total, len(data))
+		}
+		reported = append(reported, done)
+	}
+
+	if err := testUploader(s).Upload(path, "product_files/stemcell.tgz", progress); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.parts) != 3 {
+		t.Errorf("got %v parts, want 3", len(s.parts))
+	}
+	if object := s.objects["/pivnet-bucket/product_files/stemcell.tgz"]; !bytes.Equal(object, data) {
+		t.Errorf("uploaded object doesn't match (%v bytes of %v)", len(object), len(data))
+	}
+	if s.aborted {
+		t.Errorf("a successful upload was aborted")
+	}
+	sort.Slice(reported, func(i, j int) bool { return reported[i] < reported[j] })
+	if len(reported) != 4 || reported[0] != 0 || reported[3] != int64(len(data)) {
+		t.Errorf("got progress %v", reported)
+	}
+}
+
+func TestS3UploadChecksETags(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		change  func(s *fakeS3)
+		want    string
+		aborted bool // a completed upload is deleted instead
+	}{
+		{"part", func(s *fakeS3) { s.BadPartETag = 2 }, "part 2 has ETag", true},
+		{"object", func(s *fakeS3) { s.BadFinalETag = true }, "has ETag 0123-1", false},
+	} {
+		s := newFakeS3(t)
+		tc.change(s)
+		path, _ := testUploadFile(t)
+
+		err := testUploader(s).Upload(path, "stemcell.tgz", nil)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: got error %v, want one saying %q", tc.name, err, tc.want)
+		}
+		if s.aborted != tc.aborted {
+			t.Errorf("%v: got aborted %v, want %v", tc.name, s.aborted, tc.aborted)
+		}
+		if len(s.objects) != 0 {
+			t.Errorf("%v: the object was left in the bucket", tc.name)
+		}
+	}
+}
+
+func TestS3UploadAbortsOnFailure(t *testing.T) {
+	s := newFakeS3(t)
+	path, _ := testUploadFile(t)
+	inner := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("partNumber") == "3" {
+			http.Error(w, "InternalError", http.StatusInternalServerError)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+
+	if err := testUploader(s).Upload(path, "stemcell.tgz", nil); err == nil || !strings.Contains(err.Error(), "part 3") {
+		t.Errorf("got error %v, want one about part 3", err)
+	}
+	if !s.aborted {
+		t.Errorf("failed upload wasn't aborted")
+	}
+	if len(s.objects) != 0 {
+		t.Errorf("failed upload was completed anyway")
+	}
+}
+
+func TestSplitParts(t *testing.T) {
+	for _, tc := range []struct {
+		partSize     int64
+		size         int64
+		wantPartSize int64
+		wantParts    int
+	}{
+		{0, 100, DefaultS3PartSize, 1},
+		{0, 0, DefaultS3PartSize, 1}, // an empty file is still one part
+		{1024, 20 * 1024 * 1024, s3MinPartSize, 4},
+		{s3MinPartSize, s3MaxParts * s3MinPartSize, s3MinPartSize, s3MaxParts},
+		{s3MinPartSize, s3MaxParts*s3MinPartSize + 1, 2 * s3MinPartSize, s3MaxParts/2 + 1},
+		{DefaultS3PartSize, 1 << 40, 128 * 1024 * 1024, 8192},
+	} {
+		u := &S3Uploader{PartSize: tc.partSize}
+		parts := u.splitParts(tc.size)
+		if len(parts) != tc.wantParts || parts[0].size != min(tc.wantPartSize, tc.size) {
+			t.Errorf("%v bytes in parts of %v: got %v parts of %v, want %v of %v", tc.size, tc.partSize, len(parts), parts[0].size, tc.wantParts, tc.wantPartSize)
+			continue
+		}
+		total := int64(0)
+		for i, part := range parts {
+			if part.number != int64(i+1) || part.offset != total {
+				t.Errorf("%v bytes: part %v is number %v at %v", tc.size, i, part.number, part.offset)
+				break
+			}
+			total += part.size
+		}
+		if total != tc.size || len(parts) > s3MaxParts {
+			t.Errorf("%v bytes: parts add up to %v, %v of them", tc.size, total, len(parts))
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package pivnetlib
+
+// Must install yaml:  go get -u gopkg.in/yaml.v2
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// What a TokenSource returns when it has nothing to offer, so a TokenChain
+// moves on to the next one
+var ErrNoToken = errors.New("no Pivnet token")
+
+// Supplies the Pivnet token, asked for before every request.  Either a legacy
+// API token or a UAA refresh token; the Client works out which.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// A token that never changes, e.g. from --token; "" has none
+type StaticToken string
+
+func (t StaticToken) Token() (string, error) {
+	if t == "" {
+		return "", ErrNoToken
+	}
+	return string(t), nil
+}
+
+// A token in an environment variable such as PIVNET_TOKEN
+type EnvToken string
+
+func (name EnvToken) Token() (string, error) {
+	if token := strings.TrimSpace(os.Getenv(string(name))); token != "" {
+		return token, nil
+	}
+	return "", ErrNoToken
+}
+
+// A file holding just the token, re-read every time so the file can be
+// replaced while a long publish is running.  The file has to exist.
+type TokenFile string
+
+func (path TokenFile) Token() (string, error) {
+	fileArr, err := ioutil.ReadFile(string(path))
+	if err != nil {
+		return "", err
+	}
+	fileContents := strings.Trim(string(fileArr), " \n\r")
+	if fileContents == "" {
+		return "", errors.New(fmt.Sprintf("no Pivnet token in %v", path))
+	}
+	return fileContents, nil
+}
+
+// Like TokenFile, but a missing file just means no token
+type OptionalTokenFile string
+
+func (path OptionalTokenFile) Token() (string, error) {
+	if _, err := os.Stat(string(path)); os.IsNotExist(err) {
+		return "", ErrNoToken
+	}
+	return TokenFile(path).Token()
+}
+
+// The pivnet_token in a YAML config file such as DefaultConfigFile().  A
+// missing file, or one without a pivnet_token, means no token.
+type ConfigFileToken string
+
+type configFile struct {
+	PivnetToken string `yaml:"pivnet_token"`
+}
+
+func (path ConfigFileToken) Token() (string, error) {
+	data, err := ioutil.ReadFile(string(path))
+	if os.IsNotExist(err) {
+		return "", ErrNoToken
+	}
+	if err != nil {
+		return "", err
+	}
+	var config configFile
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return "", errors.New(fmt.Sprintf("can't read %v: %v", path, err))
+	}
+	if token := strings.TrimSpace(config.PivnetToken); token != "" {
+		return token, nil
+	}
+	return "", ErrNoToken
+}
+
+// $XDG_CONFIG_HOME/stemcells/config.yml, or ~/.config/stemcells/config.yml
+func DefaultConfigFile() string {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "stemcells", "config.yml")
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".config", "stemcells", "config.yml")
+	}
+	return ""
+}
+
+// Tries each source in turn and uses the first token found.  Errors other than
+// ErrNoToken stop the search, so a --token-file that can't be read isn't
+// quietly skipped.
+type TokenChain []TokenSource
+
+func (chain TokenChain) Token() (string, error) {
+	for _, source := range chain {
+		token, err := source.Token()
+		if err == ErrNoToken {
+			continue
+		}
+		return token, err
+	}
+	return "", errors.New(fmt.Sprintf("no Pivnet token (set $PIVNET_TOKEN, pass --token or --token-file, or put pivnet_token in %v)", DefaultConfigFile()))
+}
+
+// $PIVNET_TOKEN, then DefaultConfigFile(), then DefaultTokenFilePath
+func DefaultTokens() TokenChain {
+	chain := TokenChain{EnvToken("PIVNET_TOKEN")}
+	if path := DefaultConfigFile(); path != "" {
+		chain = append(chain, ConfigFileToken(path))
+	}
+	return append(chain, OptionalTokenFile(DefaultTokenFilePath))
+}
+
+// What the --token and --token-file flags say ("" for unset), falling back
+// to DefaultTokens
+func TokensFromFlags(token string, tokenFile string) TokenChain {
+	chain := TokenChain{StaticToken(token)}
+	if tokenFile != "" {
+		chain = append(chain, TokenFile(tokenFile))
+	}
+	return append(chain, DefaultTokens()...)
+}
@@ -0,0 +1,36 @@
+package pivnetlib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTokensFromFlags(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("PIVNET_TOKEN", "from-env")
+	tokenFile := filepath.Join(home, "token")
+	os.WriteFile(tokenFile, []byte("from-file\n"), 0600)
+
+	for _, tc := range []struct {
+		token     string
+		tokenFile string
+		want      string
+	}{
+		{"from-flag", tokenFile, "from-flag"},
+		{"", tokenFile, "from-file"},
+		{"", "", "from-env"},
+	} {
+		token, err := TokensFromFlags(tc.token, tc.tokenFile).Token()
+		if err != nil || token != tc.want {
+			t.Errorf("--token %q --token-file %q: got %q (%v), want %q", tc.token, tc.tokenFile, token, err, tc.want)
+		}
+	}
+
+	// A --token-file that isn't there is an error, not skipped
+	if _, err := TokensFromFlags("", filepath.Join(home, "missing")).Token(); err == nil {
+		t.Errorf("got no error for a missing --token-file")
+	}
+}
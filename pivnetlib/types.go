@@ -1,17 +1,5 @@
 package pivnetlib
 
-import (
-	"io/ioutil"
-	"strings"
-)
-
-//
-// Constants
-//
-const pivnetTokenFilePath = "/home/ubuntu/.pivnet_token"
-const urlPrefix = "https://network.pivotal.io"
-const bDebug = false
-
 //
 // PivNet JSON types
 //
@@ -55,16 +43,32 @@ type Release struct {
 	ReleaseInner ReleaseInner `json:"release"`
 }
 
-//
-// Read PivNet token
-//
-func getPivNetToken() (string, error) {
-	fileArr, err := ioutil.ReadFile(pivnetTokenFilePath)
-	if err != nil {
-		return "", err
-	}
-	fileContents := string(fileArr)
-	fileContents = strings.Trim(fileContents, " \n\r")
-	//fmt.Printf("%v,%s\n", len(fileContents), fileContents)
-	return fileContents, nil
+// A release as Pivnet reports it
+type ReleaseInfo struct {
+	Id                    int               `json:"id"`
+	Version               string            `json:"version"`
+	ReleaseType           string            `json:"release_type"`
+	ReleaseDate           string            `json:"release_date"`
+	Description           string            `json:"description"`
+	ReleaseNotesUrl       string            `json:"release_notes_url"`
+	Availability          string            `json:"availability"`
+	EndOfSupportDate      string            `json:"end_of_support_date"`
+	EndOfGuidanceDate     string            `json:"end_of_guidance_date"`
+	EndOfAvailabilityDate string            `json:"end_of_availability_date"`
+	Controlled            bool              `json:"controlled"`
+	Eccn                  string            `json:"eccn"`
+	LicenseException      string            `json:"license_exception"`
+	UpdatedAt             string            `json:"updated_at"`
+	ProductFiles          []ProductFileInfo `json:"product_files,omitempty"` // only from GetRelease
+}
+
+// A product file as Pivnet reports it
+type ProductFileInfo struct {
+	Id           int    `json:"id"`
+	Name         string `json:"name"`
+	AwsObjectKey string `json:"aws_object_key"`
+	FileVersion  string `json:"file_version"`
+	FileType     string `json:"file_type"`
+	Md5          string `json:"md5"`
+	Size         int64  `json:"size"`
 }
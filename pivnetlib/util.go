@@ -1,162 +1,209 @@
 package pivnetlib
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/golang-basic/go-curl"
-	"regexp"
+	"io/ioutil"
+	"net/http"
 	"strings"
+
+	"github.com/mgoelzer/stemcells/httplib"
 )
 
 //
 // Hits Pivnet authentication verification endpoint to verify everything is working
 //
-func VerifyAuthentication() (responseHeaders string, responseBodyJsonObj interface{}, errRet error) {
-	// Read the pivnet token
-	pivnetToken, err := getPivNetToken()
+func (c *Client) VerifyAuthentication() (responseHeaders string, responseBodyJsonObj interface{}, errRet error) {
+	// set the url
+	endpointUrl := c.url("/api/v2/authentication")
+	req, err := c.newRequest("GET", endpointUrl, nil)
 	if err != nil {
 		errRet = err
 		return
 	}
 
-	easy := curl.EasyInit()
-	defer easy.Cleanup()
-
-	// set the url
-	endpointUrl := fmt.Sprintf("%v/api/v2/authentication", urlPrefix)
-	easy.Setopt(curl.OPT_URL, endpointUrl)
-	easy.Setopt(curl.OPT_VERBOSE, false)
-	//fmt.Printf("DEBUG:  endpointUrl='%v'\n", endpointUrl)
-
-	// set the pivnet headers
-	addPivNetHttpHeaders(easy, pivnetToken)
-
-	// set function to collect response data into string buffer
-	response := ""
-	fWriteToString := func(buf []byte, userdata interface{}) bool {
-		if bDebug {
-			fmt.Printf("authentication response> %s", string(buf))
-		}
-		response += string(buf)
-		return true
-	}
-	easy.Setopt(curl.OPT_WRITEFUNCTION, fWriteToString)
-
-	// invoke curl
-	if err := easy.Perform(); err != nil {
-		fmt.Printf("curl failed\n")
+	// send the request
+	resp, err := c.transport.Do(req)
+	if err != nil {
+		c.logf("request failed\n")
 		errRet = err
 		return
 	}
 
 	// check the http response status
-	statusCodeMsg, responseHeaders, responseBodyJsonObj, err := checkHttpResponse(response)
+	statusCodeMsg, responseHeaders, responseBodyJsonObj, err := c.checkHttpResponse(resp)
 	if err != nil {
-		fmt.Printf("checkHttpResponse returned err=%v\n", err)
+		c.logf("checkHttpResponse returned err=%v\n", err)
 		errRet = err
 		return
 	} else {
-		if bDebug {
-			fmt.Printf("GetAuthentication success:  %v\n", statusCodeMsg)
-		}
+		c.logf("GetAuthentication success:  %v\n", statusCodeMsg)
 		return
 	}
 
 }
 
-func checkHttpResponse(response string) (statusCodeMsg string, responseHeaders string, responseBodyJsonObj interface{}, errRet error) {
-	// Find status line and return nil for 2xx
-	var responseLines []string
-	responseLines = strings.Split(response, "\n")
-	var responseHeaderLines []string
-	var responseBodyLines []string
-	bInHeaders := true
-	for _, line := range responseLines {
-		line = strings.Trim(line, " \n\r")
-		if bInHeaders {
-			responseHeaderLines = append(responseHeaderLines, line)
-		} else {
-			responseBodyLines = append(responseBodyLines, line)
-		}
-		if line == "" {
-			bInHeaders = false
-		}
+// Reads and closes the response body, and returns an error unless the status
+// is 2xx
+func (c *Client) checkHttpResponse(resp *http.Response) (statusCodeMsg string, responseHeaders string, responseBodyJsonObj interface{}, errRet error) {
+	defer resp.Body.Close()
 
-		if strings.HasPrefix(line, "Status:") {
-			if bDebug {
-				fmt.Println("checkHttpResponse>>" + line)
-			}
-			r, _ := regexp.Compile("Status: ([0-9]+ .*)")
-			line = strings.Trim(line, " \r\n")
-			if r.MatchString(line) {
-				arr := r.FindStringSubmatch(line)
-				statusCodeMsg = arr[1]
-				if strings.HasPrefix(statusCodeMsg, "20") {
-					errRet = nil
-				} else {
-					errRet = errors.New(fmt.Sprintf("Failed ('Status: %v')\n", statusCodeMsg))
-				}
-			}
-		}
+	statusCodeMsg = resp.Status
+	c.logf("checkHttpResponse>>%v\n", statusCodeMsg)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		errRet = errors.New(fmt.Sprintf("Failed ('Status: %v')\n", statusCodeMsg))
 	}
-	responseHeaders = strings.Join(responseHeaderLines, "\n")
+	responseHeaders = httplib.FormatHeaders(resp)
 
-	responseBodyStr := strings.Join(responseBodyLines, "\n")
-	responseBodyStr = strings.Trim(responseBodyStr, " \n\r")
-	if bDebug {
-		fmt.Printf("\n--in:checkHttpResponse--")
-		fmt.Printf("\n----responseBodyStr-----")
-		fmt.Printf("\n%v\n", responseBodyStr)
-		fmt.Printf("------------------------\n")
+	responseBodyByteArr, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		errRet = err
+		return
 	}
+	responseBodyStr := strings.Trim(string(responseBodyByteArr), " \n\r")
+	c.logf("checkHttpResponse body:\n%v\n", responseBodyStr)
 	if responseBodyStr != "" {
-		responseBodyByteArr := []byte(responseBodyStr)
-		err := json.Unmarshal(responseBodyByteArr, &responseBodyJsonObj)
-		if err != nil {
+		err := json.Unmarshal([]byte(responseBodyStr), &responseBodyJsonObj)
+		if err != nil && errRet == nil {
 			errRet = err
 		}
-		if bDebug {
-			fmt.Printf("Dumping 'responseBodyJsonObj':\n")
-			dumpArbitraryJsonObject(responseBodyJsonObj, "")
-			fmt.Printf("/dumping 'responseBodyJsonObj'\n")
+		if c.logger != nil && err == nil {
+			c.logf("Dumping 'responseBodyJsonObj':\n")
+			c.dumpArbitraryJsonObject(responseBodyJsonObj, "")
+			c.logf("/dumping 'responseBodyJsonObj'\n")
 		}
 	}
 
 	return
 }
 
-func dumpArbitraryJsonObject(responseBodyJsonObj interface{}, indent string) {
+func (c *Client) dumpArbitraryJsonObject(responseBodyJsonObj interface{}, indent string) {
 	if indent == "" {
-		fmt.Printf("\n")
+		c.logf("\n")
+	}
+	m, ok := responseBodyJsonObj.(map[string]interface{})
+	if !ok {
+		c.logf("%s(%T) '%v'\n", indent, responseBodyJsonObj, responseBodyJsonObj)
+		return
 	}
-	m := responseBodyJsonObj.(map[string]interface{})
 	for k, v := range m {
 		switch vv := v.(type) {
 		case string:
-			fmt.Printf("%s'%v' is string '%v'\n", indent, k, vv)
+			c.logf("%s'%v' is string '%v'\n", indent, k, vv)
 		case int:
-			fmt.Printf("%s'%v' is int '%v'\n", indent, k, vv)
+			c.logf("%s'%v' is int '%v'\n", indent, k, vv)
 		case float64:
-			fmt.Printf("%s'%v' is float64 '%v'\n", indent, k, vv)
+			c.logf("%s'%v' is float64 '%v'\n", indent, k, vv)
 		case []interface{}:
-			fmt.Printf("%s'%v' is an array:\n", indent, k)
+			c.logf("%s'%v' is an array:\n", indent, k)
 			for i, u := range vv {
-				fmt.Printf("%s  [%v] '%v'\n", indent, i, u)
+				c.logf("%s  [%v] '%v'\n", indent, i, u)
 			}
 		case map[string]interface{}:
-			fmt.Printf("%s'%v' is recursive type\n", indent, k)
-			dumpArbitraryJsonObject(vv, indent+"  ")
+			c.logf("%s'%v' is recursive type\n", indent, k)
+			c.dumpArbitraryJsonObject(vv, indent+"  ")
 		default:
-			fmt.Printf("%s'%v' is complex type (%T)\n", indent, k, vv)
+			c.logf("%s'%v' is complex type (%T)\n", indent, k, vv)
+		}
+	}
+}
+
+// authorization is "Token <legacy token>" or "Bearer <access token>"
+func (c *Client) addPivNetHttpHeaders(req *http.Request, authorization string) {
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("User-Agent", c.userAgent)
+}
+
+// Builds a request to the Pivnet API with the pivnet headers set
+func (c *Client) newRequest(method string, endpointUrl string, postData []byte) (*http.Request, error) {
+	authorization, err := c.auth.header()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, endpointUrl, bytes.NewReader(postData))
+	if err != nil {
+		return nil, err
+	}
+	c.addPivNetHttpHeaders(req, authorization)
+	return req, nil
+}
+
+// Sends a POST that creates something.  A POST can't simply be sent again, so
+// after a failure that might not have reached Pivnet, findExisting is asked
+// for the id of anything an earlier attempt created; only if there is none is
+// the POST retried.
+func (c *Client) postWithRetry(what string, newRequest func() (*http.Request, error), findExisting func() (int, error)) (resp *http.Response, existingId int, errRet error) {
+	retry := httplib.DefaultRetryPolicy
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			errRet = err
+			return
+		}
+		resp, errRet = c.transport.Do(req)
+		if attempt >= retry.MaxAttempts || !httplib.Retryable(resp, errRet) {
+			return
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		retry.Wait(what, attempt, resp, errRet)
+
+		id, err := findExisting()
+		if err != nil {
+			// Can't tell whether it went through, so don't risk a duplicate
+			errRet = errors.New(fmt.Sprintf("%v failed and can't check for a duplicate before retrying: %v", what, err))
+			resp = nil
+			return
+		}
+		if id > 0 {
+			c.logf("%v already went through (id %v)\n", what, id)
+			resp, errRet, existingId = nil, nil, id
+			return
 		}
 	}
 }
 
-func addPivNetHttpHeaders(easy *curl.CURL, pivnetToken string) {
-	easy.Setopt(curl.OPT_HTTPHEADER, []string{
-		"Accept: application/json",
-		"Content-Type: application/json",
-		"Authorization: Token " + pivnetToken})
-	easy.Setopt(curl.OPT_HEADER, 1)
+// Decodes a reply checkHttpResponse parsed into the typed struct v, so a
+// reply of the wrong shape is an error rather than a panic
+func decodeReply(responseBodyJsonObj interface{}, v interface{}) error {
+	data, err := json.Marshal(responseBodyJsonObj)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// GETs a Pivnet API endpoint and decodes the JSON reply into v
+func (c *Client) getJson(endpointUrl string, v interface{}) error {
+	req, err := c.newRequest("GET", endpointUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.transport.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &notFoundError{endpointUrl}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("GET %v failed ('Status: %v')", endpointUrl, resp.Status))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// What getJson returns for a 404, so a lookup can tell something that isn't
+// there from a request that failed
+type notFoundError struct {
+	endpointUrl string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("GET %v failed ('Status: 404 Not Found')", e.endpointUrl)
 }
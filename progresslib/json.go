@@ -0,0 +1,89 @@
+package progresslib
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// One JSON object per line for other programs to follow along, between a
+// "begin" event listing the labels and an "end" event:
+//
+//	{"event":"start","index":0,"label":"...","time":"..."}
+//	{"event":"progress","index":0,"label":"...","bytes":123,"total":456,"bytes_per_second":78.9,"time":"..."}
+//	{"event":"finish","index":0,"label":"...","bytes":456,"error":"...","time":"..."}
+//
+// Progress events for a transfer are sent at most every DefaultInterval.
+type JSONReporter struct {
+	mu        sync.Mutex
+	enc       *json.Encoder
+	transfers []transfer
+	lastSent  []time.Time
+}
+
+type progressEvent struct {
+	Event          string    `json:"event"`           // "begin", "start", "progress", "finish" or "end"
+	Index          *int      `json:"index,omitempty"` // not on begin and end
+	Label          string    `json:"label,omitempty"`
+	Labels         []string  `json:"labels,omitempty"`
+	Bytes          int64     `json:"bytes,omitempty"`
+	Total          int64     `json:"total,omitempty"`
+	BytesPerSecond float64   `json:"bytes_per_second,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+func NewJSONReporter(out io.Writer) *JSONReporter {
+	return &JSONReporter{enc: json.NewEncoder(out)}
+}
+
+func (r *JSONReporter) Begin(labels []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers = newTransfers(labels)
+	r.lastSent = make([]time.Time, len(labels))
+	r.enc.Encode(progressEvent{Event: "begin", Labels: labels, Time: time.Now()})
+}
+
+func (r *JSONReporter) Start(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers[i].state = "running"
+	r.transfers[i].started = time.Now()
+	r.enc.Encode(progressEvent{Event: "start", Index: &i, Label: r.transfers[i].label, Time: time.Now()})
+}
+
+func (r *JSONReporter) Update(i int, done, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := &r.transfers[i]
+	t.update(done, total)
+	if time.Since(r.lastSent[i]) < DefaultInterval {
+		return
+	}
+	r.lastSent[i] = time.Now()
+	r.enc.Encode(progressEvent{Event: "progress", Index: &i, Label: t.label, Bytes: done, Total: total, BytesPerSecond: t.rate(), Time: time.Now()})
+}
+
+func (r *JSONReporter) Finish(i int, label string, done int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := &r.transfers[i]
+	if label != "" {
+		t.label = label
+	}
+	t.done = done
+	t.finished = time.Now()
+	event := progressEvent{Event: "finish", Index: &i, Label: t.label, Bytes: done, BytesPerSecond: t.rate(), Time: t.finished}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	r.enc.Encode(event)
+}
+
+func (r *JSONReporter) End() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(progressEvent{Event: "end", Time: time.Now()})
+}
@@ -0,0 +1,81 @@
+package progresslib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plain lines for logs: one when each transfer starts and finishes, and a
+// summary of the running ones every interval
+type PlainReporter struct {
+	mu        sync.Mutex
+	out       io.Writer
+	interval  time.Duration
+	transfers []transfer
+	lastLog   time.Time
+}
+
+func NewPlainReporter(out io.Writer, interval time.Duration) *PlainReporter {
+	return &PlainReporter{out: out, interval: interval}
+}
+
+func (r *PlainReporter) Begin(labels []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers = newTransfers(labels)
+	r.lastLog = time.Now()
+}
+
+func (r *PlainReporter) Start(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers[i].state = "running"
+	r.transfers[i].started = time.Now()
+	fmt.Fprintf(r.out, "%v: started\n", r.transfers[i].label)
+}
+
+func (r *PlainReporter) Update(i int, done, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers[i].update(done, total)
+	if time.Since(r.lastLog) < r.interval {
+		return
+	}
+	for i := range r.transfers {
+		if t := &r.transfers[i]; t.state == "running" {
+			fmt.Fprintf(r.out, "%v: %v\n", t.label, t.plainProgress())
+		}
+	}
+	r.lastLog = time.Now()
+}
+
+func (r *PlainReporter) Finish(i int, label string, done int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := &r.transfers[i]
+	if label != "" {
+		t.label = label
+	}
+	t.done = done
+	t.finished = time.Now()
+	t.err = err
+	if err != nil {
+		t.state = "failed"
+		fmt.Fprintf(r.out, "%v: FAILED (%v)\n", t.label, strings.TrimSpace(err.Error()))
+		return
+	}
+	t.state = "done"
+	fmt.Fprintf(r.out, "%v: done, %v in %v, %v/s\n", t.label, formatBytes(float64(done)), t.finished.Sub(t.started).Round(time.Second), formatBytes(t.rate()))
+}
+
+func (r *PlainReporter) End() {}
+
+func (t *transfer) plainProgress() string {
+	if percent := t.percent(); percent >= 0 {
+		return fmt.Sprintf("%.1f%% (%v of %v), %v/s", percent, formatBytes(float64(t.done)), formatBytes(float64(t.total)), formatBytes(t.rate()))
+	}
+	return fmt.Sprintf("%v, %v/s", formatBytes(float64(t.done)), formatBytes(t.rate()))
+}
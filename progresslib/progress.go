@@ -0,0 +1,151 @@
+package progresslib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Shows how a batch of transfers (stemcell downloads, S3 uploads) is going.
+// Transfers are numbered by their position in the labels given to Begin.
+// Implementations must be safe to call from several goroutines.
+type ProgressReporter interface {
+	Begin(labels []string)
+	Start(i int)
+	// done and total are in bytes; total is 0 when it isn't known yet
+	Update(i int, done, total int64)
+	// label replaces the one given to Begin, e.g. with the real filename
+	Finish(i int, label string, done int64, err error)
+	End()
+}
+
+// Values for --progress
+const (
+	ProgressAuto  = "auto"
+	ProgressTTY   = "tty"
+	ProgressPlain = "plain"
+	ProgressJSON  = "json"
+	ProgressNone  = "none"
+)
+
+// How often reporters redraw or log, at most
+const DefaultInterval = 250 * time.Millisecond
+
+// How often the plain reporter logs progress
+const DefaultLogInterval = 10 * time.Second
+
+// Picks a reporter by name.  "auto" means redrawn bars on a terminal and
+// plain log lines otherwise (pipes, files and CI logs).
+func NewReporter(kind string, out io.Writer) (ProgressReporter, error) {
+	switch kind {
+	case ProgressAuto, "":
+		if IsTerminal(out) {
+			return NewTTYReporter(out), nil
+		}
+		return NewPlainReporter(out, DefaultLogInterval), nil
+	case ProgressTTY:
+		return NewTTYReporter(out), nil
+	case ProgressPlain:
+		return NewPlainReporter(out, DefaultLogInterval), nil
+	case ProgressJSON:
+		return NewJSONReporter(out), nil
+	case ProgressNone:
+		return NoProgress{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown progress style '%v' (want auto, tty, plain, json or none)", kind))
+}
+
+// Whether out is a terminal that understands cursor movement
+func IsTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Reports nothing
+type NoProgress struct{}
+
+func (NoProgress) Begin(labels []string)                             {}
+func (NoProgress) Start(i int)                                       {}
+func (NoProgress) Update(i int, done, total int64)                   {}
+func (NoProgress) Finish(i int, label string, done int64, err error) {}
+func (NoProgress) End()                                              {}
+
+// What every reporter keeps about a transfer
+type transfer struct {
+	label    string
+	state    string // "waiting", "running", "done" or "failed"
+	started  time.Time
+	finished time.Time
+	done     int64
+	total    int64
+	err      error
+
+	// Bytes already there when the transfer started, e.g. a resumed .part
+	// file, which don't count towards the rate
+	resumed    int64
+	resumedSet bool
+}
+
+func newTransfers(labels []string) []transfer {
+	transfers := make([]transfer, len(labels))
+	for i, label := range labels {
+		transfers[i] = transfer{label: label, state: "waiting"}
+	}
+	return transfers
+}
+
+// Records progress.  The first update after Start says where the transfer
+// is starting from.
+func (t *transfer) update(done, total int64) {
+	if !t.resumedSet || done < t.resumed {
+		// Started over, e.g. the server couldn't resume
+		t.resumed = done
+		t.resumedSet = true
+	}
+	t.done = done
+	t.total = total
+}
+
+// Bytes per second moved since Start; 0 until some time has passed
+func (t *transfer) rate() float64 {
+	end := time.Now()
+	if !t.finished.IsZero() {
+		end = t.finished
+	}
+	elapsed := end.Sub(t.started).Seconds()
+	if t.started.IsZero() || elapsed <= 0 {
+		return 0
+	}
+	if t.done <= t.resumed {
+		return 0
+	}
+	return float64(t.done-t.resumed) / elapsed
+}
+
+// Percent done, or -1 if the total isn't known
+func (t *transfer) percent() float64 {
+	if t.total <= 0 {
+		return -1
+	}
+	return float64(t.done) / float64(t.total) * 100
+}
+
+// e.g. "12.3MiB"
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%v", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%v", n, units[i])
+}
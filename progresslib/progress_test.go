@@ -0,0 +1,33 @@
+package progresslib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLeavesOutResumedBytes(t *testing.T) {
+	tr := transfer{started: time.Now().Add(-10 * time.Second)}
+
+	// 900 bytes were in the .part file; 100 more came in 10s
+	tr.update(900, 1000)
+	tr.update(1000, 1000)
+	if rate := tr.rate(); rate < 9 || rate > 10.1 {
+		t.Errorf("got %v bytes/s, want about 10", rate)
+	}
+
+	// The server couldn't resume, so it starts over
+	tr.update(0, 1000)
+	tr.update(500, 1000)
+	if rate := tr.rate(); rate < 45 || rate > 50.1 {
+		t.Errorf("got %v bytes/s after starting over, want about 50", rate)
+	}
+}
+
+func TestRateOfFreshTransfer(t *testing.T) {
+	tr := transfer{started: time.Now().Add(-4 * time.Second)}
+	tr.update(0, 0)
+	tr.update(400, 0)
+	if rate := tr.rate(); rate < 95 || rate > 100.1 {
+		t.Errorf("got %v bytes/s, want about 100", rate)
+	}
+}
@@ -0,0 +1,107 @@
+package progresslib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One line per transfer, redrawn in place with ANSI cursor movement
+type TTYReporter struct {
+	mu        sync.Mutex
+	out       io.Writer
+	transfers []transfer
+	drawn     int // lines on screen from the last redraw
+	lastDrawn time.Time
+}
+
+func NewTTYReporter(out io.Writer) *TTYReporter {
+	return &TTYReporter{out: out}
+}
+
+func (r *TTYReporter) Begin(labels []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers = newTransfers(labels)
+	r.drawn = 0
+	r.redraw()
+}
+
+func (r *TTYReporter) Start(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers[i].state = "running"
+	r.transfers[i].started = time.Now()
+	r.redraw()
+}
+
+func (r *TTYReporter) Update(i int, done, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers[i].update(done, total)
+	if time.Since(r.lastDrawn) >= DefaultInterval {
+		r.redraw()
+	}
+}
+
+func (r *TTYReporter) Finish(i int, label string, done int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := &r.transfers[i]
+	if label != "" {
+		t.label = label
+	}
+	t.done = done
+	t.finished = time.Now()
+	t.err = err
+	if err != nil {
+		t.state = "failed"
+	} else {
+		t.state = "done"
+	}
+	r.redraw()
+}
+
+func (r *TTYReporter) End() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.redraw()
+}
+
+// Caller must hold r.mu
+func (r *TTYReporter) redraw() {
+	if r.drawn > 0 {
+		// Move the cursor back up to the first line of the display
+		fmt.Fprintf(r.out, "\033[%dA", r.drawn)
+	}
+	for i := range r.transfers {
+		fmt.Fprintf(r.out, "\033[K%v\n", r.transfers[i].ttyLine())
+	}
+	r.drawn = len(r.transfers)
+	r.lastDrawn = time.Now()
+}
+
+const barWidth = 30
+
+func (t *transfer) ttyLine() string {
+	switch t.state {
+	case "waiting":
+		return fmt.Sprintf("%v: waiting", t.label)
+	case "failed":
+		return fmt.Sprintf("%v: FAILED (%v)", t.label, strings.TrimSpace(t.err.Error()))
+	case "done":
+		return fmt.Sprintf("%v: done, %v, %v/s", t.label, formatBytes(float64(t.done)), formatBytes(t.rate()))
+	}
+	percent := t.percent()
+	if percent < 0 {
+		return fmt.Sprintf("%v: %v, %v/s", t.label, formatBytes(float64(t.done)), formatBytes(t.rate()))
+	}
+	filled := int(percent / 100 * barWidth)
+	if filled > barWidth {
+		filled = barWidth
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+	return fmt.Sprintf("%v: [%v] %5.1f%% of %v, %v/s", t.label, bar, percent, formatBytes(float64(t.total)), formatBytes(t.rate()))
+}
@@ -0,0 +1,196 @@
+package publishlib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mgoelzer/stemcells/pivnetlib"
+	"github.com/mgoelzer/stemcells/progresslib"
+	"github.com/mgoelzer/stemcells/stemcelllib"
+)
+
+// Puts a local file at an S3 object key.  pivnetlib.S3Uploader is the real
+// one; tests can use a fake.
+type Uploader interface {
+	Upload(localPath string, objectKey string, progress func(done, total int64)) error
+}
+
+// The Pivnet calls publishing makes.  PivNetApi is the real one; tests can
+// use a fake.
+type ReleaseApi interface {
+	CreateRelease(productSlug string, version string, description string) (releaseId int, err error)
+	CreateProductFile(productSlug string, file pivnetlib.ProductFileInner) (productFileId int, err error)
+	AddProductFileToRelease(productSlug string, releaseId int, productFileId int) error
+}
+
+// ReleaseApi on top of a pivnetlib Client
+type PivNetApi struct {
+	Client *pivnetlib.Client
+}
+
+func (api PivNetApi) CreateRelease(productSlug string, version string, description string) (int, error) {
+	releaseId, _, _, err := api.Client.CreateRelease(productSlug, version, description)
+	return releaseId, err
+}
+
+func (api PivNetApi) CreateProductFile(productSlug string, file pivnetlib.ProductFileInner) (int, error) {
+	productFileId, _, _, err := api.Client.CreateProductFile(productSlug, file.Name, file.AwsObjectKey, file.Description, file.Md5, file.FileVersion, file.DocsUrl, time.Now())
+	return productFileId, err
+}
+
+func (api PivNetApi) AddProductFileToRelease(productSlug string, releaseId int, productFileId int) error {
+	return api.Client.AddProductFileToRelease(productSlug, releaseId, productFileId)
+}
+
+// Everything a publish run needs besides the stemcells and version
+type PublishOptions struct {
+	ProductSlug string
+	Description string // of the release; "" for a default
+	DocsUrl     string
+	S3Prefix    string // object keys are S3Prefix + filename
+	Parallel    int
+	Fetch       *stemcelllib.FetchOptions
+	Uploader    Uploader
+	Api         ReleaseApi                   // e.g. PivNetApi{Client: ...}
+	Progress    progresslib.ProgressReporter // nil for none
+}
+
+// One stemcell as published
+type PublishedFile struct {
+	Filename      string
+	ObjectKey     string
+	Md5           string
+	ProductFileId int
+}
+
+type PublishResult struct {
+	ReleaseId int
+	Files     []PublishedFile
+}
+
+// Downloads the stemcells, uploads each to S3, creates the Pivnet release and
+// a product file (with its MD5) per stemcell, and attaches them to the
+// release.  Stops at the first thing that fails; whatever was created by then
+// is in the result.
+func Publish(specs []stemcelllib.StemcellSpec, version stemcelllib.Version, opts PublishOptions) (result PublishResult, errRet error) {
+	api := opts.Api
+	if api == nil {
+		errRet = errors.New("no Pivnet API to create the release with")
+		return
+	}
+	if opts.Uploader == nil {
+		errRet = errors.New("nothing to upload stemcells with")
+		return
+	}
+	reporter := opts.Progress
+	if reporter == nil {
+		reporter = progresslib.NoProgress{}
+	}
+
+	// Download
+	fetched := stemcelllib.FetchAll(specs, version, opts.Parallel, opts.Fetch, reporter)
+	var failures []string
+	for _, f := range fetched {
+		if f.Err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", f.Label(), f.Err))
+		}
+	}
+	if len(failures) > 0 {
+		errRet = errors.New(fmt.Sprintf("%v of %v stemcells failed to download: %v", len(failures), len(fetched), strings.Join(failures, "; ")))
+		return
+	}
+
+	// Upload, one at a time (the rate limit and S3's own parallelism make
+	// more pointless)
+	labels := []string{}
+	for _, f := range fetched {
+		labels = append(labels, opts.S3Prefix+f.StemcellFilename)
+	}
+	reporter.Begin(labels)
+	for i, f := range fetched {
+		objectKey := labels[i]
+		reporter.Start(i)
+		err := opts.Uploader.Upload(f.Path, objectKey, func(done, total int64) {
+			reporter.Update(i, done, total)
+		})
+		reporter.Finish(i, objectKey, int64(f.StemcellBytes), err)
+		if err != nil {
+			reporter.End()
+			errRet = errors.New(fmt.Sprintf("upload of %v failed: %v", f.Path, err))
+			return
+		}
+		result.Files = append(result.Files, PublishedFile{Filename: f.StemcellFilename, ObjectKey: objectKey, Md5: f.Md5})
+	}
+	reporter.End()
+
+	// Release
+	description := opts.Description
+	if description == "" {
+		description = fmt.Sprintf("BOSH stemcells version %v", version)
+	}
+	releaseId, err := api.CreateRelease(opts.ProductSlug, version.String(), description)
+	if err != nil {
+		errRet = errors.New(fmt.Sprintf("can't create release %v: %v", version, err))
+		return
+	}
+	result.ReleaseId = releaseId
+
+	// Product files
+	for i, f := range fetched {
+		file := pivnetlib.ProductFileInner{
+			AwsObjectKey: result.Files[i].ObjectKey,
+			Description:  fmt.Sprintf("%v version %v", f.Label(), version),
+			DocsUrl:      opts.DocsUrl,
+			FileVersion:  version.String(),
+			Md5:          f.Md5,
+			Name:         ProductFileName(f.StemcellBoshIoName, f.Flavor),
+		}
+		productFileId, err := api.CreateProductFile(opts.ProductSlug, file)
+		if err != nil {
+			errRet = errors.New(fmt.Sprintf("can't create product file for %v: %v", f.StemcellFilename, err))
+			return
+		}
+		result.Files[i].ProductFileId = productFileId
+		if err := api.AddProductFileToRelease(opts.ProductSlug, releaseId, productFileId); err != nil {
+			errRet = errors.New(fmt.Sprintf("can't add %v to release %v: %v", f.StemcellFilename, releaseId, err))
+			return
+		}
+	}
+	return
+}
+
+var iaasDisplayNames = map[string]string{
+	"aws":       "AWS",
+	"azure":     "Azure",
+	"google":    "Google Cloud Platform",
+	"openstack": "OpenStack",
+	"vcloud":    "vCloud",
+	"vsphere":   "vSphere",
+	"warden":    "BOSH Lite",
+}
+
+// Human name for a stemcell's product file, e.g. "Ubuntu Trusty Stemcell for
+// AWS" (or "... for AWS (full)")
+func ProductFileName(stemcellBoshIoName string, flavor string) string {
+	spec, err := stemcelllib.ParseBoshIoName(stemcellBoshIoName)
+	if err != nil {
+		return stemcellBoshIoName
+	}
+	osWords := strings.Split(spec.OS, "-")
+	for i, word := range osWords {
+		if word != "" {
+			osWords[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	iaas := iaasDisplayNames[spec.Iaas]
+	if iaas == "" {
+		iaas = spec.Iaas
+	}
+	name := fmt.Sprintf("%v Stemcell for %v", strings.Join(osWords, " "), iaas)
+	if flavor == stemcelllib.FlavorFull {
+		name += " (full)"
+	}
+	return name
+}
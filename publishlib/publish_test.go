@@ -0,0 +1,214 @@
+package publishlib
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mgoelzer/stemcells/pivnetlib"
+	"github.com/mgoelzer/stemcells/stemcelllib"
+)
+
+const (
+	testVsphere   = "bosh-vsphere-esxi-ubuntu-trusty-go_agent"
+	testOpenstack = "bosh-openstack-kvm-ubuntu-trusty-go_agent"
+)
+
+// Records what would have gone to S3
+type fakeUploader struct {
+	Fail map[string]error // object key -> error
+
+	mutex sync.Mutex
+	keys  []string
+}
+
+func (u *fakeUploader) Upload(localPath string, objectKey string, progress func(done, total int64)) error {
+	if err := u.Fail[objectKey]; err != nil {
+		return err
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	progress(info.Size(), info.Size())
+	u.mutex.Lock()
+	u.keys = append(u.keys, objectKey)
+	u.mutex.Unlock()
+	return nil
+}
+
+// Records what would have been made on Pivnet
+type fakeReleaseApi struct {
+	ReleaseId        int
+	CreateReleaseErr error
+	CreateFileErr    error
+	AddErr           error
+
+	releases []string
+	files    []pivnetlib.ProductFileInner
+	attached []string
+}
+
+func (api *fakeReleaseApi) CreateRelease(productSlug string, version string, description string) (int, error) {
+	if api.CreateReleaseErr != nil {
+		return 0, api.CreateReleaseErr
+	}
+	api.releases = append(api.releases, fmt.Sprintf("%v %v %v", productSlug, version, description))
+	return api.ReleaseId, nil
+}
+
+func (api *fakeReleaseApi) CreateProductFile(productSlug string, file pivnetlib.ProductFileInner) (int, error) {
+	if api.CreateFileErr != nil {
+		return 0, api.CreateFileErr
+	}
+	api.files = append(api.files, file)
+	return 500 + len(api.files), nil
+}
+
+func (api *fakeReleaseApi) AddProductFileToRelease(productSlug string, releaseId int, productFileId int) error {
+	if api.AddErr != nil {
+		return api.AddErr
+	}
+	api.attached = append(api.attached, fmt.Sprintf("%v/%v", releaseId, productFileId))
+	return nil
+}
+
+// A local mirror with one stemcell per name (and its .sha256), and options
+// that fetch from it
+func testPublishSetup(t *testing.T, names ...string) ([]stemcelllib.StemcellSpec, stemcelllib.Version, PublishOptions, map[string]string) {
+	version, err := stemcelllib.ParseVersion("3026")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror := t.TempDir()
+	var specs []stemcelllib.StemcellSpec
+	md5s := map[string]string{}
+	for _, name := range names {
+		spec, err := stemcelllib.ParseBoshIoName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		specs = append(specs, spec)
+		filename := spec.Filename(version)
+		content := []byte("stemcell " + name)
+		os.WriteFile(filepath.Join(mirror, filename), content, 0644)
+		os.WriteFile(filepath.Join(mirror, filename+".sha256"), []byte(fmt.Sprintf("%x", sha256.Sum256(content))), 0644)
+		md5s[filename] = fmt.Sprintf("%x", md5.Sum(content))
+	}
+	opts := PublishOptions{
+		ProductSlug: "stemcells",
+		S3Prefix:    "product_files/Pivotal-CF/",
+		Parallel:    2,
+		Fetch: &stemcelllib.FetchOptions{
+			Sources:     []stemcelllib.Source{stemcelllib.NewLocalDirSource(mirror)},
+			SkipInspect: true,
+			OutputDir:   t.TempDir(),
+		},
+		Uploader: &fakeUploader{},
+		Api:      &fakeReleaseApi{ReleaseId: 42},
+	}
+	return specs, version, opts, md5s
+}
+
+func TestPublish(t *testing.T) {
+	specs, version, opts, md5s := testPublishSetup(t, testVsphere, testOpenstack)
+	opts.DocsUrl = "http://docs.example.com"
+	api := opts.Api.(*fakeReleaseApi)
+
+	result, err := Publish(specs, version, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ReleaseId != 42 {
+		t.Errorf("got release %v, want 42", result.ReleaseId)
+	}
+	if len(api.releases) != 1 || api.releases[0] != "stemcells 3026 BOSH stemcells version 3026" {
+		t.Errorf("got releases %q", api.releases)
+	}
+	if uploaded := opts.Uploader.(*fakeUploader).keys; len(uploaded) != 2 {
+		t.Errorf("got uploads %q", uploaded)
+	}
+	if len(result.Files) != 2 || len(api.files) != 2 {
+		t.Fatalf("got %v files in the result and %v product files", len(result.Files), len(api.files))
+	}
+	wantNames := []string{"Ubuntu Trusty Stemcell for vSphere", "Ubuntu Trusty Stemcell for OpenStack"}
+	for i, file := range result.Files {
+		productFile := api.files[i]
+		if file.ObjectKey != opts.S3Prefix+file.Filename || productFile.AwsObjectKey != file.ObjectKey {
+			t.Errorf("%v: uploaded as %v, product file points at %v", file.Filename, file.ObjectKey, productFile.AwsObjectKey)
+		}
+		if file.Md5 != md5s[file.Filename] || productFile.Md5 != file.Md5 {
+			t.Errorf("%v: got md5 %v (product file %v), want %v", file.Filename, file.Md5, productFile.Md5, md5s[file.Filename])
+		}
+		if productFile.Name != wantNames[i] || productFile.FileVersion != "3026" || productFile.DocsUrl != opts.DocsUrl {
+			t.Errorf("got product file %+v", productFile)
+		}
+		if file.ProductFileId != 501+i {
+			t.Errorf("%v: got product file id %v", file.Filename, file.ProductFileId)
+		}
+	}
+	if strings.Join(api.attached, ",") != "42/501,42/502" {
+		t.Errorf("got attached %q", api.attached)
+	}
+}
+
+func TestPublishErrors(t *testing.T) {
+	boom := errors.New("boom")
+	for _, tc := range []struct {
+		name     string
+		change   func(opts *PublishOptions)
+		want     string
+		released bool // whether a release should have been created
+	}{
+		{"no api", func(opts *PublishOptions) { opts.Api = nil }, "no Pivnet API", false},
+		{"no uploader", func(opts *PublishOptions) { opts.Uploader = nil }, "nothing to upload", false},
+		{"download", func(opts *PublishOptions) {
+			opts.Fetch.Sources = []stemcelllib.Source{stemcelllib.NewLocalDirSource(t.TempDir())}
+		}, "failed to download", false},
+		{"upload", func(opts *PublishOptions) {
+			opts.Uploader = &fakeUploader{Fail: map[string]error{opts.S3Prefix + "bosh-stemcell-3026-vsphere-esxi-ubuntu-trusty-go_agent.tgz": boom}}
+		}, "upload of", false},
+		{"release", func(opts *PublishOptions) { opts.Api.(*fakeReleaseApi).CreateReleaseErr = boom }, "can't create release 3026: boom", false},
+		{"product file", func(opts *PublishOptions) { opts.Api.(*fakeReleaseApi).CreateFileErr = boom }, "can't create product file", true},
+		{"attach", func(opts *PublishOptions) { opts.Api.(*fakeReleaseApi).AddErr = boom }, "can't add", true},
+	} {
+		specs, version, opts, _ := testPublishSetup(t, testVsphere)
+		tc.change(&opts)
+
+		result, err := Publish(specs, version, opts)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: got error %v, want one saying %q", tc.name, err, tc.want)
+		}
+		if released := result.ReleaseId != 0; released != tc.released {
+			t.Errorf("%v: got release %v", tc.name, result.ReleaseId)
+		}
+		if api, ok := opts.Api.(*fakeReleaseApi); ok && !tc.released && len(api.files) > 0 {
+			t.Errorf("%v: product files were created anyway", tc.name)
+		}
+	}
+}
+
+func TestProductFileName(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		flavor string
+		want   string
+	}{
+		{testVsphere, "", "Ubuntu Trusty Stemcell for vSphere"},
+		{"bosh-aws-xen-hvm-ubuntu-trusty-go_agent", stemcelllib.FlavorLight, "Ubuntu Trusty Stemcell for AWS"},
+		{"bosh-aws-xen-hvm-ubuntu-trusty-go_agent", stemcelllib.FlavorFull, "Ubuntu Trusty Stemcell for AWS (full)"},
+		{"bosh-google-kvm-centos-7-go_agent", "", "Centos 7 Stemcell for Google Cloud Platform"},
+		{"bosh-softlayer-esxi-ubuntu-xenial-go_agent", "", "Ubuntu Xenial Stemcell for softlayer"},
+		{"not-a-stemcell", "", "not-a-stemcell"},
+	} {
+		if got := ProductFileName(tc.name, tc.flavor); got != tc.want {
+			t.Errorf("%v %v: got %q, want %q", tc.name, tc.flavor, got, tc.want)
+		}
+	}
+}
@@ -3,208 +3,930 @@ package main
 // Must install codegangsta/cli:  go get -u github.com/codegangsta/cli
 
 import (
-	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/golang-basic/go-curl"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/mgoelzer/stemcells/httplib"
 	"github.com/mgoelzer/stemcells/pivnetlib"
+	"github.com/mgoelzer/stemcells/progresslib"
+	"github.com/mgoelzer/stemcells/publishlib"
+	"github.com/mgoelzer/stemcells/stemcelllib"
 
 	"github.com/codegangsta/cli"
 )
 
-const boshIoUrlPrefix = "https://bosh.io/d/stemcells/"
-
-const awsStemcellBoshIoName = "bosh-aws-xen-hvm-ubuntu-trusty-go_agent"
-const vsphereStemcellBoshIoName = "bosh-vsphere-esxi-ubuntu-trusty-go_agent"
-const vcdStemcellBoshIoName = "bosh-vcloud-esxi-ubuntu-trusty-go_agent"
-const openstackStemcellBoshIoName = "bosh-openstack-kvm-ubuntu-trusty-go_agent-raw"
-
-const appHelpTemplate = `{{.Name}} {{.Version}} - fetches stemcells for vSphere, vCD, Openstack and AWS
+const appHelpTemplate = `{{.Name}} {{.Version}} - fetches stemcells from bosh.io (by default trusty for vSphere, vCD, Openstack and AWS)
 {{.Copyright}}
 
 USAGE
   {{.Usage}}
 
+COMMANDS
+  {{range .Commands}}{{join .Names ", "}}{{ "\t" }}{{.Usage}}
+  {{end}}
 FLAGS
   {{range .Flags}}{{.}}
   {{end}}
 
 EXAMPLE
   stemcell 3026
+  stemcell 3026.12
+  stemcell --parallel 2 3026
+  stemcell --iaas aws,google --os trusty,xenial 3262
+  stemcell --iaas warden --hypervisor boshlite 3026
+  stemcell --stemcells-file my-stemcells.txt 3026
+  stemcell --iaas aws --aws-flavor both 3026
+  stemcell latest
+  stemcell 3026.latest
+  stemcell --os jammy latest
+  stemcell --manifest stemcells.json 3026
+  stemcell --source https://mirror.example.com/stemcells --source bosh.io 3026
+  stemcell --limit-rate 20MiB/s 3026
+  stemcell --progress json 3026
+  stemcell --dry-run --iaas aws --aws-flavor full 3026
+  stemcell --output-dir /srv/artifacts --layout '{{.OS}}/{{.Version}}/{{.Filename}}' 3026
+  stemcell publish --s3-bucket pivnet-bucket 3026
+  stemcell release list
+  stemcell release show 3026
+  stemcell release add-file --release-version 3026 12345 12346
+  stemcell inspect light-bosh-stemcell-3026-aws-xen-hvm-ubuntu-trusty-go_agent.tgz
+  stemcell cache ls
+  stemcell cache prune --older-than 720h
 `
 
-const pivnetProductSlug = "stemcells"
+const (
+	pivnetProductSlug = "stemcells"
+	pivnetDocsUrl     = "http://docs.pivotal.io"
+)
 
-/***************************************************************/
-// Temporary section
-/***************************************************************/
+func main() {
+	app := cli.NewApp()
+	app.Name = "stemcell"
+	app.Version = "0.1.0"
+	app.Usage = fmt.Sprintf("%s [FLAGS] VERSION|latest|MAJOR.latest", app.Name)
+	app.Commands = []cli.Command{
+		{
+			Name:      "inspect",
+			Usage:     "print a stemcell tarball's stemcell.MF and check its image",
+			ArgsUsage: "FILE",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print JSON instead of text",
+				},
+			},
+			Action: inspectCommand,
+		},
+		{
+			Name:      "publish",
+			Usage:     "fetch the stemcells, upload them to S3 and release them on Pivnet",
+			ArgsUsage: "VERSION|latest|MAJOR.latest",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "product-slug",
+					Value: pivnetProductSlug,
+					Usage: "Pivnet product to release the stemcells under",
+				},
+				cli.StringFlag{
+					Name:   "s3-bucket",
+					Usage:  "S3 bucket behind the product's files",
+					EnvVar: "S3_BUCKET",
+				},
+				cli.StringFlag{
+					Name:   "s3-region",
+					Value:  pivnetlib.DefaultS3Region,
+					Usage:  "AWS region of --s3-bucket",
+					EnvVar: "AWS_REGION",
+				},
+				cli.StringFlag{
+					Name:  "s3-endpoint",
+					Usage: "S3 endpoint URL, for an S3-compatible store instead of AWS (e.g. http://127.0.0.1:9000)",
+				},
+				cli.IntFlag{
+					Name:  "s3-parallel",
+					Value: pivnetlib.DefaultS3Parallel,
+					Usage: "parts of each upload to send at the same time",
+				},
+				cli.StringFlag{
+					Name:  "s3-prefix",
+					Value: pivnetlib.DefaultS3Prefix,
+					Usage: "prefix of the uploaded objects' keys",
+				},
+				cli.StringFlag{
+					Name:  "description",
+					Usage: "release description (default \"BOSH stemcells version VERSION\")",
+				},
+				cli.StringFlag{
+					Name:  "docs-url",
+					Value: pivnetDocsUrl,
+					Usage: "documentation link on each product file",
+				},
+			},
+			Action: publishCommand,
+		},
+		{
+			Name:  "release",
+			Usage: "list and show Pivnet releases, and manage their product files",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the product's releases",
+					Flags:  releaseShowFlags,
+					Action: releaseListCommand,
+				},
+				{
+					Name:      "show",
+					Usage:     "show a release and its product files",
+					ArgsUsage: "RELEASE_ID|VERSION",
+					Flags:     releaseShowFlags,
+					Action:    releaseShowCommand,
+				},
+				{
+					Name:      "add-file",
+					Usage:     "attach product files to a release",
+					ArgsUsage: "PRODUCT_FILE_ID...",
+					Flags:     releaseFileFlags,
+					Action: func(c *cli.Context) {
+						releaseFilesCommand(c, "Added", (*pivnetlib.Client).AddProductFileToRelease)
+					},
+				},
+				{
+					Name:      "remove-file",
+					Usage:     "detach product files from a release",
+					ArgsUsage: "PRODUCT_FILE_ID...",
+					Flags:     releaseFileFlags,
+					Action: func(c *cli.Context) {
+						releaseFilesCommand(c, "Removed", (*pivnetlib.Client).RemoveProductFileFromRelease)
+					},
+				},
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "list, verify and prune the local stemcell cache",
+			Subcommands: []cli.Command{
+				{
+					Name:   "ls",
+					Usage:  "list cached stemcells",
+					Action: cacheLsCommand,
+				},
+				{
+					Name:  "verify",
+					Usage: "rehash every cached stemcell and report corrupt ones",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "remove",
+							Usage: "delete corrupt entries",
+						},
+					},
+					Action: cacheVerifyCommand,
+				},
+				{
+					Name:  "prune",
+					Usage: "delete cached stemcells that haven't been used for a while",
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "older-than",
+							Value: 30 * 24 * time.Hour,
+							Usage: "delete entries not used for this long (0 deletes everything)",
+						},
+					},
+					Action: cachePruneCommand,
+				},
+			},
+		},
+	}
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{
+			Name:  "run-tests, t",
+			Usage: "whether to run the unit tests",
+		},
+		cli.IntFlag{
+			Name:  "parallel, p",
+			Value: stemcelllib.DefaultParallel,
+			Usage: "maximum number of stemcells to download at the same time",
+		},
+		cli.StringFlag{
+			Name:  "iaas",
+			Usage: "comma-separated IaaSes to fetch (default aws,vsphere,vcloud,openstack)",
+		},
+		cli.StringFlag{
+			Name:  "os",
+			Usage: "comma-separated OS lines, e.g. trusty,xenial,jammy,windows2019 (default trusty)",
+		},
+		cli.StringFlag{
+			Name:  "hypervisor",
+			Usage: "comma-separated hypervisors, either HYPERVISOR or IAAS=HYPERVISOR (default per IaaS)",
+		},
+		cli.StringFlag{
+			Name:  "agent",
+			Value: stemcelllib.DefaultAgent,
+			Usage: "BOSH agent the stemcells are built with",
+		},
+		cli.StringFlag{
+			Name:  "stemcells-file",
+			Usage: "file listing bosh.io stemcell names, one per line (instead of --iaas/--os/--hypervisor/--agent)",
+		},
+		cli.StringFlag{
+			Name:  "aws-flavor",
+			Value: stemcelllib.FlavorLight,
+			Usage: "which AWS stemcell to fetch: light, full or both",
+		},
+		cli.StringFlag{
+			Name:  "bosh-io-url",
+			Value: stemcelllib.BoshIoUrl,
+			Usage: "base URL of bosh.io (or a mirror of its API and downloads)",
+		},
+		cli.StringSliceFlag{
+			Name:  "source",
+			Value: &cli.StringSlice{},
+			Usage: "where to fetch stemcells from, in order of preference: bosh.io, redirector:URL, http(s)://DIR or file:///DIR (default bosh.io)",
+		},
+		cli.StringFlag{
+			Name:  "manifest, m",
+			Usage: "write a manifest of the downloads to this file (YAML if it ends in .yml/.yaml, otherwise JSON)",
+		},
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Value: stemcelllib.DefaultCacheDir(),
+			Usage: "directory of stemcells kept between runs",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "always download, and don't add to the cache",
+		},
+		cli.StringFlag{
+			Name:  "progress",
+			Value: progresslib.ProgressAuto,
+			Usage: "how to show progress: auto (bars on a terminal, log lines otherwise), tty, plain, json (one event per line) or none",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "show what would be downloaded (filenames, redirects, sizes) without downloading or writing anything",
+		},
+		cli.StringFlag{
+			Name:  "output-dir, o",
+			Usage: "directory to download into (default the current directory)",
+		},
+		cli.StringFlag{
+			Name:  "layout",
+			Value: stemcelllib.DefaultLayout,
+			Usage: "path of each stemcell under --output-dir, as a Go template using .Filename, .Name, .Iaas, .Hypervisor, .OS, .Agent, .Flavor and .Version",
+		},
+		cli.BoolFlag{
+			Name:  "remove-partial",
+			Usage: "delete the .part files of failed or interrupted downloads instead of keeping them for the next run to resume",
+		},
+		cli.BoolFlag{
+			Name:  "no-inspect",
+			Usage: "don't check each download's stemcell.MF against the stemcell asked for",
+		},
+		cli.StringFlag{
+			Name:  "proxy",
+			Usage: "HTTP(S) proxy URL for all requests, e.g. http://proxy:3128 (default $HTTPS_PROXY/$HTTP_PROXY)",
+		},
+		cli.StringFlag{
+			Name:   "no-proxy",
+			Usage:  "comma-separated hosts, domains and CIDRs to reach without the proxy (default $NO_PROXY)",
+			EnvVar: "NO_PROXY,no_proxy",
+		},
+		cli.StringFlag{
+			Name:   "proxy-user",
+			Usage:  "USER:PASSWORD for the proxy, if it isn't in the proxy URL",
+			EnvVar: "PROXY_USER",
+		},
+		cli.StringSliceFlag{
+			Name:  "ca-cert",
+			Value: &cli.StringSlice{},
+			Usage: "PEM file of extra CA certificates to trust (repeatable)",
+		},
+		cli.StringFlag{
+			Name:  "client-cert",
+			Usage: "PEM client certificate to present (with --client-key)",
+		},
+		cli.StringFlag{
+			Name:  "client-key",
+			Usage: "PEM private key for --client-cert",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Value: httplib.DefaultRetryPolicy.MaxAttempts - 1,
+			Usage: "how many times to retry a failed request or broken download (0 to never retry)",
+		},
+		cli.DurationFlag{
+			Name:  "retry-delay",
+			Value: httplib.DefaultRetryPolicy.InitialDelay,
+			Usage: "backoff before the first retry, doubling (with jitter) after that",
+		},
+		cli.DurationFlag{
+			Name:  "retry-max-delay",
+			Value: httplib.DefaultRetryPolicy.MaxDelay,
+			Usage: "longest to wait between retries, including for Retry-After",
+		},
+		cli.StringFlag{
+			Name:  "pivnet-url",
+			Value: pivnetlib.DefaultBaseUrl,
+			Usage: "base URL of the Pivnet API, e.g. a staging instance",
+		},
+		cli.StringFlag{
+			Name:  "token",
+			Usage: "Pivnet API token or UAA refresh token (default $PIVNET_TOKEN, then pivnet_token in " + pivnetlib.DefaultConfigFile() + ")",
+		},
+		cli.StringFlag{
+			Name:  "token-file",
+			Usage: "file holding the Pivnet API token or UAA refresh token",
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "log Pivnet requests and replies to stderr",
+		},
+		cli.StringFlag{
+			Name:  "limit-rate",
+			Usage: "cap on the total bandwidth of all downloads and uploads together, e.g. 20MiB/s",
+		},
+	}
+	cli.AppHelpTemplate = appHelpTemplate
 
-func testCodeToAuth() {
-	if _, responseBodyJsonObj, err := pivnetlib.VerifyAuthentication(); err != nil {
-		fmt.Printf("\nERROR: %v\n%v\n", err, responseBodyJsonObj)
-		return
-	} else {
-		fmt.Printf("\nGetAuthentication:  ok\n%v\n", responseBodyJsonObj)
+	app.Action = func(c *cli.Context) {
+		if c.Bool("run-tests") {
+			fmt.Printf("Tests coming soon...\n")
+			os.Exit(0)
+		}
+		setHumanOut(c)
+		if len(c.Args()) != 1 {
+			fmt.Fprintf(humanOut, "Error:  wrong number of arguments (try --help)\n")
+			os.Exit(255)
+		}
+		specs, version, opts, reporter := fetchSetup(c, c.Args()[0])
+		parallel := c.Int("parallel")
+
+		if c.Bool("dry-run") {
+			dryRun(specs, version, parallel, opts)
+			return
+		}
+
+		handleInterrupts(c.Bool("remove-partial"))
+		results := stemcelllib.FetchAll(specs, version, parallel, opts, reporter)
+
+		if manifestPath := c.String("manifest"); manifestPath != "" {
+			if err := stemcelllib.WriteManifest(manifestPath, stemcelllib.NewManifest(results)); err != nil {
+				fmt.Fprintf(humanOut, "Error:  can't write manifest %v: %v\n", manifestPath, err)
+				os.Exit(255)
+			}
+		}
+
+		// Summary
+		fmt.Fprintf(humanOut, "\n")
+		failed := 0
+		for _, result := range results {
+			if result.Err != nil {
+				failed++
+				continue
+			}
+			fromCache := ""
+			if result.FromCache {
+				fromCache = ", from cache"
+			}
+			fmt.Fprintf(humanOut, "%v (%v bytes, %v%v)\n", result.Path, result.StemcellBytes, result.Md5, fromCache)
+			for _, warning := range result.Warnings {
+				fmt.Fprintf(humanOut, "  Warning:  %v\n", warning)
+			}
+		}
+		if failed > 0 {
+			fmt.Fprintf(humanOut, "\nERROR: %v of %v stemcells failed to download:\n", failed, len(results))
+			for _, result := range results {
+				if result.Err != nil {
+					fmt.Fprintf(humanOut, "  %v: %v\n", result.Label(), result.Err)
+				}
+			}
+			os.Exit(255)
+		}
 	}
+	app.Run(os.Args)
 }
 
-func testCodeToCreateRelease() {
-	if releaseId, _, responseBodyJsonObj, err := pivnetlib.CreateRelease(pivnetProductSlug, "1000", "Description....."); err != nil {
-		fmt.Printf("\nERROR: %v\n%v\n", err, responseBodyJsonObj)
-		return
-	} else {
-		fmt.Printf("\nCreateRelease created release Id:  %v\n", releaseId)
+// Everything the global flags say about what to fetch and how: the stemcells,
+// the resolved version, the fetch options and the progress reporter.  Works
+// from the app's context and from a subcommand's.  Exits on bad flags.
+func fetchSetup(c *cli.Context, vArg string) (specs []stemcelllib.StemcellSpec, version stemcelllib.Version, opts *stemcelllib.FetchOptions, reporter progresslib.ProgressReporter) {
+	if !stemcelllib.IsVersionQuery(vArg) {
+		if _, err := stemcelllib.ParseVersion(vArg); err != nil {
+			fmt.Fprintf(humanOut, "Error:  need a version (e.g. 3026 or 3026.12), 'latest' or 'MAJOR.latest' (try --help)\n")
+			os.Exit(255)
+		}
+	}
+
+	if c.GlobalInt("parallel") < 1 {
+		fmt.Fprintf(humanOut, "Error:  --parallel must be at least 1 (try --help)\n")
+		os.Exit(255)
+	}
+
+	specs, err := selectStemcells(c)
+	if err != nil {
+		fmt.Fprintf(humanOut, "Error:  %v (try --help)\n", err)
+		os.Exit(255)
+	}
+	stemcelllib.BoshIoUrl = c.GlobalString("bosh-io-url")
+	if err := configureHttp(c); err != nil {
+		fmt.Fprintf(humanOut, "Error:  %v (try --help)\n", err)
+		os.Exit(255)
+	}
+
+	reporter, err = progresslib.NewReporter(c.GlobalString("progress"), os.Stdout)
+	if err != nil {
+		fmt.Fprintf(humanOut, "Error:  %v (try --help)\n", err)
+		os.Exit(255)
+	}
+
+	layout, err := stemcelllib.NewLayout(c.GlobalString("layout"))
+	if err != nil {
+		fmt.Fprintf(humanOut, "Error:  %v (try --help)\n", err)
+		os.Exit(255)
 	}
+	opts = &stemcelllib.FetchOptions{
+		SkipInspect:   c.GlobalBool("no-inspect"),
+		RemovePartial: c.GlobalBool("remove-partial"),
+		OutputDir:     c.GlobalString("output-dir"),
+		Layout:        layout,
+	}
+	for _, s := range c.GlobalStringSlice("source") {
+		source, err := stemcelllib.ParseSource(s)
+		if err != nil {
+			fmt.Fprintf(humanOut, "Error:  bad --source '%v': %v (try --help)\n", s, err)
+			os.Exit(255)
+		}
+		opts.Sources = append(opts.Sources, source)
+	}
+	if !c.GlobalBool("no-cache") {
+		opts.Cache = stemcelllib.NewCache(c.GlobalString("cache-dir"))
+	}
+
+	version, err = stemcelllib.ResolveVersion(stemcelllib.BoshIoNames(specs), vArg, opts)
+	if err != nil {
+		fmt.Fprintf(humanOut, "Error:  can't resolve version '%v': %v\n", vArg, err)
+		os.Exit(255)
+	}
+	if stemcelllib.IsVersionQuery(vArg) {
+		fmt.Fprintf(humanOut, "Resolved '%v' to version %v\n", vArg, version)
+	}
+	return
 }
 
-func testCodeToDeleteRelease() {
-	releaseId := 557
-	if err := pivnetlib.DeleteRelease(pivnetProductSlug, releaseId); err != nil {
-		fmt.Printf("\nERROR: %v\n", err)
-		return
+// Works out which bosh.io stemcells the flags ask for
+func selectStemcells(c *cli.Context) ([]stemcelllib.StemcellSpec, error) {
+	var specs []stemcelllib.StemcellSpec
+	var err error
+	if path := c.GlobalString("stemcells-file"); path != "" {
+		names, err := stemcelllib.ReadStemcellList(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, errors.New(fmt.Sprintf("no stemcells listed in %v", path))
+		}
+		specs, err = stemcelllib.SpecsFromNames(names)
 	} else {
-		fmt.Printf("\nDeleteRelease deleted release Id:  %v\n", releaseId)
+		specs, err = stemcelllib.SelectStemcells(splitList(c.GlobalString("iaas")), splitList(c.GlobalString("os")), splitList(c.GlobalString("hypervisor")), c.GlobalString("agent"))
+	}
+	if err != nil {
+		return nil, err
 	}
+	return stemcelllib.ApplyAwsFlavor(specs, c.GlobalString("aws-flavor"))
 }
 
-func testCodeToCreateProductFile() {
-	if productId, responseHeaders, responseBodyJsonObj, err := pivnetlib.CreateProductFile("stemcells", "TEST PRODUCT - Ubuntu Trusty Stemcell for AWS", "product_files/Pivotal-CF/light-bosh-stemcell-2840-aws-xen-hvm-ubuntu-trusty-go_agent.tgz", "Test test test", "abcdef432523", "9999A", "http://docs.pivotal.io", time.Now()); err != nil {
-		fmt.Printf("\nCreateProductFile ERROR: %v\n%v\n%v\n", err, responseHeaders, responseBodyJsonObj)
-	} else {
-		fmt.Printf("\nCreateProductFile created product with Id:  %v\n", productId)
+// Splits a comma-separated flag value, dropping empty entries
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Where messages for people go: stdout, unless --progress json has it to
+// itself for events
+var humanOut io.Writer = os.Stdout
+
+// Called first by every command that can report progress, so even its
+// earliest errors stay off a JSON stdout
+func setHumanOut(c *cli.Context) {
+	if c.GlobalString("progress") == progresslib.ProgressJSON {
+		humanOut = os.Stderr
+	}
+}
+
+// The clients configureHttp built, for whatever doesn't pick them up from a
+// package default
+var httpClient *http.Client
+var pivnetClient *pivnetlib.Client
+
+// Builds the one HTTP client used for bosh.io, mirrors, Pivnet and S3 from the
+// proxy, TLS, retry and rate flags, and the Pivnet client on top of it
+func configureHttp(c *cli.Context) error {
+	client, err := httplib.Configure(httplib.Settings{
+		Config: httplib.Config{
+			ProxyUrl:       c.GlobalString("proxy"),
+			NoProxy:        c.GlobalString("no-proxy"),
+			ProxyUser:      c.GlobalString("proxy-user"),
+			CaFiles:        c.GlobalStringSlice("ca-cert"),
+			ClientCertFile: c.GlobalString("client-cert"),
+			ClientKeyFile:  c.GlobalString("client-key"),
+		},
+		Retries:       c.GlobalInt("retries"),
+		RetryDelay:    c.GlobalDuration("retry-delay"),
+		RetryMaxDelay: c.GlobalDuration("retry-max-delay"),
+		LimitRate:     c.GlobalString("limit-rate"),
+	})
+	if err != nil {
+		return err
 	}
+	httpClient = client
+	stemcelllib.DefaultDownloader = stemcelllib.NewHttpDownloader(client)
+	pivnetClient = pivnetlib.NewClientFromSettings(pivnetlib.Settings{
+		BaseUrl:   c.GlobalString("pivnet-url"),
+		Token:     c.GlobalString("token"),
+		TokenFile: c.GlobalString("token-file"),
+		Debug:     c.GlobalBool("debug"),
+		Program:   c.App.Name + "/" + c.App.Version,
+	}, client)
+	return nil
+}
+
+// Prints what a fetch would do, and exits non-zero if any stemcell couldn't be
+// found
+func dryRun(specs []stemcelllib.StemcellSpec, version stemcelllib.Version, parallel int, opts *stemcelllib.FetchOptions) {
+	plans := stemcelllib.PlanAll(specs, version, parallel, opts)
+	if failed := stemcelllib.WritePlans(humanOut, plans); failed > 0 {
+		fmt.Fprintf(humanOut, "\nERROR: %v of %v stemcells can't be fetched\n", failed, len(plans))
+		os.Exit(255)
+	}
+}
 
+// On SIGINT/SIGTERM, deletes whatever is half-written (except .part files,
+// unless asked to), says which stemcells didn't finish, and exits
+func handleInterrupts(removePartial bool) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		removed, kept := stemcelllib.AbortInProgress(removePartial)
+		fmt.Fprintf(humanOut, "\n\nInterrupted (%v)\n", sig)
+		for _, path := range removed {
+			fmt.Fprintf(humanOut, "  incomplete, removed:  %v\n", path)
+		}
+		for _, path := range kept {
+			fmt.Fprintf(humanOut, "  incomplete, kept:     %v\n", path)
+		}
+		if len(kept) > 0 {
+			fmt.Fprintf(humanOut, "Run again to resume the kept downloads.\n")
+		}
+		os.Exit(255)
+	}()
 }
 
 /***************************************************************/
-// End -- Temporary section
+// publish command
 /***************************************************************/
 
-func main() {
-	testCodeToAuth()
+func publishCommand(c *cli.Context) {
+	setHumanOut(c)
+	if len(c.Args()) != 1 {
+		fmt.Fprintf(humanOut, "Error:  wrong number of arguments (try --help)\n")
+		os.Exit(255)
+	}
+	if c.String("s3-bucket") == "" {
+		fmt.Fprintf(humanOut, "Error:  need --s3-bucket (try --help)\n")
+		os.Exit(255)
+	}
+	specs, version, fetchOpts, reporter := fetchSetup(c, c.Args()[0])
+
+	handleInterrupts(c.GlobalBool("remove-partial"))
+	result, err := publishlib.Publish(specs, version, publishlib.PublishOptions{
+		ProductSlug: c.String("product-slug"),
+		Description: c.String("description"),
+		DocsUrl:     c.String("docs-url"),
+		S3Prefix:    c.String("s3-prefix"),
+		Parallel:    c.GlobalInt("parallel"),
+		Fetch:       fetchOpts,
+		Uploader: &pivnetlib.S3Uploader{
+			Bucket:   c.String("s3-bucket"),
+			Region:   c.String("s3-region"),
+			Endpoint: c.String("s3-endpoint"),
+			Parallel: c.Int("s3-parallel"),
+			Client:   httpClient,
+		},
+		Api:      publishlib.PivNetApi{Client: pivnetClient},
+		Progress: reporter,
+	})
+	fmt.Fprintf(humanOut, "\n")
+	for _, file := range result.Files {
+		if file.ProductFileId != 0 {
+			fmt.Fprintf(humanOut, "%v (product file %v, %v)\n", file.ObjectKey, file.ProductFileId, file.Md5)
+		} else {
+			fmt.Fprintf(humanOut, "%v (uploaded, %v)\n", file.ObjectKey, file.Md5)
+		}
+	}
+	if err != nil {
+		if result.ReleaseId != 0 {
+			fmt.Fprintf(humanOut, "Release %v was created but is incomplete\n", result.ReleaseId)
+		}
+		fmt.Fprintf(humanOut, "Error:  %v\n", err)
+		os.Exit(255)
+	}
+	fmt.Fprintf(humanOut, "Release %v created\n", result.ReleaseId)
+}
 
-	//testCodeToCreateRelease()
-	//testCodeToDeleteRelease()
-	os.Exit(1)
-	///////////////////////////////
+/***************************************************************/
+// release commands
+/***************************************************************/
 
-	stemcellNames := append(make([]string, 0, 4),
-		awsStemcellBoshIoName, vsphereStemcellBoshIoName, vcdStemcellBoshIoName, openstackStemcellBoshIoName)
-	app := cli.NewApp()
-	app.Name = "stemcell"
-	app.Version = "0.1.0"
-	app.Usage = fmt.Sprintf("%s [FLAGS] VERSION", app.Name)
-	app.Commands = nil
-	app.Flags = []cli.Flag{
-		cli.BoolFlag{
-			Name:  "run-tests, t",
-			Usage: "whether to run the unit tests",
-		},
+var releaseFileFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "product-slug",
+		Value: pivnetProductSlug,
+		Usage: "Pivnet product the release belongs to",
+	},
+	cli.IntFlag{
+		Name:  "release-id",
+		Usage: "id of the release",
+	},
+	cli.StringFlag{
+		Name:  "release-version",
+		Usage: "version of the release (instead of --release-id), e.g. 3026",
+	},
+}
+
+var releaseShowFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "product-slug",
+		Value: pivnetProductSlug,
+		Usage: "Pivnet product whose releases to look at",
+	},
+	cli.BoolFlag{
+		Name:  "json",
+		Usage: "print JSON instead of a table",
+	},
+}
+
+func releaseListCommand(c *cli.Context) {
+	if len(c.Args()) != 0 {
+		fmt.Printf("Error:  wrong number of arguments (try --help)\n")
+		os.Exit(255)
+	}
+	if err := configureHttp(c); err != nil {
+		fmt.Printf("Error:  %v (try --help)\n", err)
+		os.Exit(255)
+	}
+	releases, err := pivnetClient.ListReleases(c.String("product-slug"))
+	if err != nil {
+		fmt.Printf("Error:  can't list releases: %v\n", err)
+		os.Exit(255)
 	}
-	cli.AppHelpTemplate = appHelpTemplate
 
-	app.Action = func(c *cli.Context) {
-		if c.Bool("run-tests") {
-			fmt.Printf("Tests coming soon...\n")
-			os.Exit(0)
+	if c.Bool("json") {
+		printJson(releases)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tVERSION\tTYPE\tDATE\tAVAILABILITY\n")
+	for _, release := range releases {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", release.Id, release.Version, release.ReleaseType, release.ReleaseDate, release.Availability)
+	}
+	w.Flush()
+}
+
+func releaseShowCommand(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Printf("Error:  wrong number of arguments (try --help)\n")
+		os.Exit(255)
+	}
+	if err := configureHttp(c); err != nil {
+		fmt.Printf("Error:  %v (try --help)\n", err)
+		os.Exit(255)
+	}
+	productSlug := c.String("product-slug")
+	found, err := pivnetClient.ResolveRelease(productSlug, c.Args()[0])
+	if err != nil {
+		fmt.Printf("Error:  %v\n", err)
+		os.Exit(255)
+	}
+	release, err := pivnetClient.GetRelease(productSlug, found.Id)
+	if err != nil {
+		fmt.Printf("Error:  can't get release %v: %v\n", found.Id, err)
+		os.Exit(255)
+	}
+
+	if c.Bool("json") {
+		printJson(release)
+		return
+	}
+	fmt.Printf("Id:            %v\n", release.Id)
+	fmt.Printf("Version:       %v\n", release.Version)
+	fmt.Printf("Type:          %v\n", release.ReleaseType)
+	fmt.Printf("Date:          %v\n", release.ReleaseDate)
+	fmt.Printf("Availability:  %v\n", release.Availability)
+	if release.Description != "" {
+		fmt.Printf("Description:   %v\n", release.Description)
+	}
+	if release.EndOfSupportDate != "" {
+		fmt.Printf("Support ends:  %v\n", release.EndOfSupportDate)
+	}
+	fmt.Printf("\nProduct files (%v):\n", len(release.ProductFiles))
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "  ID\tNAME\tOBJECT KEY\tMD5\n")
+	for _, file := range release.ProductFiles {
+		fmt.Fprintf(w, "  %v\t%v\t%v\t%v\n", file.Id, file.Name, file.AwsObjectKey, file.Md5)
+	}
+	w.Flush()
+}
+
+func printJson(v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Printf("Error:  %v\n", err)
+		os.Exit(255)
+	}
+	fmt.Printf("%s\n", out)
+}
+
+// Works out the release from --release-id or --release-version
+func releaseFromFlags(c *cli.Context, productSlug string) (int, error) {
+	releaseId := c.Int("release-id")
+	vArg := c.String("release-version")
+	switch {
+	case releaseId != 0 && vArg != "":
+		return 0, errors.New("need --release-id or --release-version, not both")
+	case releaseId < 0:
+		return 0, errors.New("--release-id must be positive")
+	case releaseId > 0:
+		return releaseId, nil
+	case vArg != "":
+		version, err := stemcelllib.ParseVersion(vArg)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("bad --release-version '%v': %v", vArg, err))
 		}
-		if len(c.Args()) != 1 {
-			fmt.Printf("Error:  wrong number of arguments (try --help)\n")
+		release, err := pivnetClient.FindReleaseByVersion(productSlug, version.String())
+		if err != nil {
+			return 0, err
+		}
+		return release.Id, nil
+	}
+	return 0, errors.New("need --release-id or --release-version")
+}
+
+// Adds or removes each product file given as an argument
+func releaseFilesCommand(c *cli.Context, verb string, change func(client *pivnetlib.Client, productSlug string, releaseId int, productFileId int) error) {
+	if len(c.Args()) == 0 {
+		fmt.Printf("Error:  need at least one product file id (try --help)\n")
+		os.Exit(255)
+	}
+	productFileIds := []int{}
+	for _, arg := range c.Args() {
+		productFileId, err := strconv.Atoi(arg)
+		if err != nil || productFileId <= 0 {
+			fmt.Printf("Error:  '%v' isn't a product file id (try --help)\n", arg)
 			os.Exit(255)
 		}
-		vArg := c.Args()[0]
-		version, err := strconv.Atoi(vArg)
-		if (err != nil) || (version <= 0) || (version > 99999) {
-			fmt.Printf("Error:  need a numeric argument (try --help)\n")
+		productFileIds = append(productFileIds, productFileId)
+	}
+	if err := configureHttp(c); err != nil {
+		fmt.Printf("Error:  %v (try --help)\n", err)
+		os.Exit(255)
+	}
+
+	productSlug := c.String("product-slug")
+	releaseId, err := releaseFromFlags(c, productSlug)
+	if err != nil {
+		fmt.Printf("Error:  %v\n", err)
+		os.Exit(255)
+	}
+	for _, productFileId := range productFileIds {
+		if err := change(pivnetClient, productSlug, releaseId, productFileId); err != nil {
+			fmt.Printf("Error:  product file %v, release %v: %v\n", productFileId, releaseId, err)
 			os.Exit(255)
 		}
+		fmt.Printf("%v product file %v on release %v\n", verb, productFileId, releaseId)
+	}
+}
 
-		for _, value := range stemcellNames {
-			stemcellBoshIoName := value
-			stemcellFilename, stemcellBytes, md5, err := fetchStemcell(stemcellBoshIoName, version)
-			if err != nil {
-				fmt.Println("fetchStemcell failed")
-				os.Exit(255)
-			}
-			fmt.Printf("%v (%v bytes, %v)\n", stemcellFilename, stemcellBytes, md5)
+/***************************************************************/
+// inspect command
+/***************************************************************/
+
+func inspectCommand(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Printf("Error:  need the stemcell tarball to inspect (try --help)\n")
+		os.Exit(255)
+	}
+	info, err := stemcelllib.InspectStemcell(c.Args()[0])
+	if err != nil {
+		fmt.Printf("Error:  %v\n", err)
+		os.Exit(255)
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			fmt.Printf("Error:  %v\n", err)
+			os.Exit(255)
+		}
+		fmt.Printf("%s\n", data)
+	} else {
+		m := info.Metadata
+		fmt.Printf("File:              %v\n", info.Path)
+		fmt.Printf("Name:              %v\n", m.Name)
+		fmt.Printf("Version:           %v\n", m.Version)
+		fmt.Printf("Operating system:  %v\n", m.OperatingSystem)
+		fmt.Printf("Infrastructure:    %v\n", m.CloudProperty("infrastructure"))
+		fmt.Printf("Hypervisor:        %v\n", m.CloudProperty("hypervisor"))
+		if len(m.StemcellFormats) > 0 {
+			fmt.Printf("Stemcell formats:  %v\n", strings.Join(m.StemcellFormats, ", "))
+		}
+		fmt.Printf("Image:             %v bytes, sha1 %v\n", info.ImageSize, info.ImageSha1)
+		fmt.Printf("stemcell.MF sha1:  %v\n", m.Sha1)
+		fmt.Printf("Cloud properties:\n")
+		keys := []string{}
+		for k := range m.CloudProperties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("  %v: %v\n", k, m.CloudProperties[k])
 		}
 	}
-	app.Run(os.Args)
+
+	if !info.ImageMatches() {
+		fmt.Printf("\nERROR: image does not match the sha1 in stemcell.MF\n")
+		os.Exit(255)
+	}
 }
 
-func check(e error) {
-	if e != nil {
-		fmt.Printf("\n\n")
-		panic(e)
-	}
-}
-
-func fetchStemcell(stemcellBoshIoName string, version int) (string, int, string, error) {
-	easy := curl.EasyInit()
-	defer easy.Cleanup()
-
-	// Set the URL to fetch
-	stemcellUrl := fmt.Sprintf("%v?v=%v", stemcellBoshIoName, version)
-	//fmt.Println("DEBUG:  " + boshIoUrlPrefix + stemcellUrl)
-	easy.Setopt(curl.OPT_URL, boshIoUrlPrefix+stemcellUrl)
-	easy.Setopt(curl.OPT_VERBOSE, false)
-
-	// Get the name in "Location:" header without actually redirecting yet
-	easy.Setopt(curl.OPT_FOLLOWLOCATION, false)
-	fWriteToDevNull := func(buf []byte, userdata interface{}) bool { return true }
-	easy.Setopt(curl.OPT_WRITEFUNCTION, fWriteToDevNull)
-	err := easy.Perform()
-	check(err)
-	locationString, err := easy.Getinfo(curl.INFO_REDIRECT_URL)
-	check(err)
-	//fmt.Printf("DEBUG:  locationString='%v'\n", locationString)
-
-	locationStringParts := strings.Split(locationString.(string), "/")
-	locationStringPartsLen := len(locationStringParts)
-	stemcellFilename := locationStringParts[locationStringPartsLen-1]
-	//fmt.Printf("DEBUG:  stemcellFilename='%v'\n",stemcellFilename)
-
-	// Open the stemcell file for writing (will be in current dir)
-	stemcellLocalPath := stemcellFilename
-	f, err := os.Create(stemcellLocalPath)
-	check(err)
-	defer f.Close()
-
-	// Now fetch again with redirect to fetch file
-	easy.Setopt(curl.OPT_FOLLOWLOCATION, true)
-	bytesWritten := 0
-
-	hash := md5.New()
-	fWriteToFile := func(buf []byte, userdata interface{}) bool {
-		bytesWritten += len(buf)
-		//fmt.Println("DEBUG:  size=>", len(buf))
-		f.Write(buf)
-		hash.Write(buf)
-		//println("data = >", string(buf))
-		return true
-	}
-	easy.Setopt(curl.OPT_WRITEFUNCTION, fWriteToFile)
-
-	// Progress bar
-	easy.Setopt(curl.OPT_NOPROGRESS, false)
-	started := int64(0)
-	easy.Setopt(curl.OPT_PROGRESSFUNCTION, func(dltotal, dlnow, ultotal, ulnow float64, userdata interface{}) bool {
-		if started == 0 {
-			started = time.Now().Unix()
-		}
-		fmt.Printf("%v: %3.2f%%, Speed: %.1fKiB/s \r", stemcellFilename, dlnow/dltotal*100, dlnow/1000/float64((time.Now().Unix()-started)))
-		return true
-	})
+/***************************************************************/
+// cache commands
+/***************************************************************/
 
-	if err := easy.Perform(); err != nil {
-		fmt.Printf("ERROR: %v\n", err)
-		return "", 0, "", errors.New("curl failed")
+func cacheLsCommand(c *cli.Context) {
+	cache := stemcelllib.NewCache(c.GlobalString("cache-dir"))
+	entries, err := cache.Entries()
+	if err != nil {
+		fmt.Printf("Error:  %v\n", err)
+		os.Exit(255)
 	}
+	for _, entry := range entries {
+		fmt.Printf("%v %v %v (%v bytes, %v, last used %v)\n", entry.BoshIoName, entry.Version, entry.Filename, entry.Size, entry.ChecksumKey, entry.LastUsed.Format("2006-01-02"))
+	}
+	fmt.Printf("%v stemcells in %v\n", len(entries), cache.Dir)
+}
 
-	return stemcellFilename, bytesWritten, fmt.Sprintf("%x", hash.Sum(nil)), nil
+func cacheVerifyCommand(c *cli.Context) {
+	cache := stemcelllib.NewCache(c.GlobalString("cache-dir"))
+	entries, err := cache.Entries()
+	if err != nil {
+		fmt.Printf("Error:  %v\n", err)
+		os.Exit(255)
+	}
+	bad := 0
+	for _, entry := range entries {
+		if _, err := cache.Verify(entry); err != nil {
+			bad++
+			fmt.Printf("BAD  %v\n", err)
+			if c.Bool("remove") {
+				if err := cache.Remove(entry); err != nil {
+					fmt.Printf("Error:  can't remove %v: %v\n", entry.Path, err)
+				}
+			}
+			continue
+		}
+		fmt.Printf("ok   %v\n", entry.Path)
+	}
+	if bad > 0 {
+		fmt.Printf("\nERROR: %v of %v cached stemcells are corrupt\n", bad, len(entries))
+		os.Exit(255)
+	}
+}
+
+func cachePruneCommand(c *cli.Context) {
+	cache := stemcelllib.NewCache(c.GlobalString("cache-dir"))
+	removed, err := cache.Prune(c.Duration("older-than"))
+	for _, entry := range removed {
+		fmt.Printf("removed %v\n", entry.Path)
+	}
+	if err != nil {
+		fmt.Printf("Error:  %v\n", err)
+		os.Exit(255)
+	}
+	fmt.Printf("%v stemcells removed from %v\n", len(removed), cache.Dir)
 }
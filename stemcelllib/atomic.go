@@ -0,0 +1,93 @@
+package stemcelllib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Files being written right now, so that an interrupted run can clean up
+// after itself and say what it left unfinished
+var inProgress = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// Records path as being written until the returned func is called
+func trackInProgress(path string) func() {
+	inProgress.Lock()
+	inProgress.paths[path] = true
+	inProgress.Unlock()
+	return func() {
+		inProgress.Lock()
+		delete(inProgress.paths, path)
+		inProgress.Unlock()
+	}
+}
+
+// For SIGINT/SIGTERM handlers: deletes every file still being written and
+// returns their names.  .part files are left (and returned in kept) so the
+// next run can resume them, unless removePartial.
+func AbortInProgress(removePartial bool) (removed []string, kept []string) {
+	inProgress.Lock()
+	defer inProgress.Unlock()
+	for path := range inProgress.paths {
+		if !removePartial && strings.HasSuffix(path, partFileSuffix) {
+			kept = append(kept, path)
+			continue
+		}
+		if err := os.Remove(path); err == nil || os.IsNotExist(err) {
+			removed = append(removed, path)
+		} else {
+			kept = append(kept, path)
+		}
+	}
+	inProgress.paths = map[string]bool{}
+	sort.Strings(removed)
+	sort.Strings(kept)
+	return
+}
+
+// Writes a file so that it's either all there or not there at all: into a
+// temp file next to it, synced, then renamed over it
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	done := trackInProgress(f.Name())
+	defer done()
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// Makes a rename in dir survive a crash.  Best effort: not every filesystem
+// can sync a directory.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
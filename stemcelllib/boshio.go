@@ -0,0 +1,101 @@
+package stemcelllib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Base URL of bosh.io; can be pointed at a mirror or a local fake of it
+var BoshIoUrl = "https://bosh.io"
+
+func boshIoApiUrlPrefix(baseUrl string) string {
+	return strings.TrimRight(baseUrl, "/") + "/api/v1/stemcells/"
+}
+
+// bosh.io API JSON types
+type BoshIoStemcellFile struct {
+	Url    string `json:"url"`
+	Size   int64  `json:"size"`
+	Md5    string `json:"md5"`
+	Sha1   string `json:"sha1"`
+	Sha256 string `json:"sha256"`
+}
+
+type BoshIoStemcell struct {
+	Name    string              `json:"name"`
+	Version string              `json:"version"`
+	Light   *BoshIoStemcellFile `json:"light"`
+	Regular *BoshIoStemcellFile `json:"regular"`
+}
+
+// Lists every version bosh.io knows about for a stemcell, newest first
+func GetBoshIoStemcells(stemcellBoshIoName string, opts *FetchOptions) ([]BoshIoStemcell, error) {
+	return getBoshIoStemcells(BoshIoUrl, stemcellBoshIoName, opts)
+}
+
+// Same, from a bosh.io-style API at baseUrl
+func getBoshIoStemcells(baseUrl string, stemcellBoshIoName string, opts *FetchOptions) ([]BoshIoStemcell, error) {
+	endpointUrl := boshIoApiUrlPrefix(baseUrl) + stemcellBoshIoName
+	resp, err := opts.downloader().Get(endpointUrl, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("%v returned HTTP %v", endpointUrl, resp.Status))
+	}
+
+	var stemcells []BoshIoStemcell
+	if err := json.NewDecoder(resp.Body).Decode(&stemcells); err != nil {
+		return nil, errors.New(fmt.Sprintf("bad JSON from %v: %v", endpointUrl, err))
+	}
+	return stemcells, nil
+}
+
+// What bosh.io publishes for one version of a stemcell
+func GetPublishedStemcell(stemcellBoshIoName string, version Version, opts *FetchOptions) (*BoshIoStemcell, error) {
+	return getPublishedStemcell(BoshIoUrl, stemcellBoshIoName, version, opts)
+}
+
+func getPublishedStemcell(baseUrl string, stemcellBoshIoName string, version Version, opts *FetchOptions) (*BoshIoStemcell, error) {
+	stemcells, err := getBoshIoStemcells(baseUrl, stemcellBoshIoName, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i, stemcell := range stemcells {
+		if stemcellVersion, err := ParseVersion(stemcell.Version); err == nil && stemcellVersion.Equal(version) {
+			return &stemcells[i], nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("%v does not list %v version %v", baseUrl, stemcellBoshIoName, version))
+}
+
+// Finds what bosh.io publishes (url, size and checksums) for the file a
+// stemcell version downloads as
+func GetPublishedStemcellFile(stemcellBoshIoName string, version Version, stemcellFilename string, opts *FetchOptions) (*BoshIoStemcellFile, error) {
+	return getPublishedStemcellFile(BoshIoUrl, stemcellBoshIoName, version, stemcellFilename, opts)
+}
+
+func getPublishedStemcellFile(baseUrl string, stemcellBoshIoName string, version Version, stemcellFilename string, opts *FetchOptions) (*BoshIoStemcellFile, error) {
+	stemcell, err := getPublishedStemcell(baseUrl, stemcellBoshIoName, version, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Prefer an exact filename match, then go by the light- prefix
+	for _, file := range []*BoshIoStemcellFile{stemcell.Light, stemcell.Regular} {
+		if file != nil && path.Base(file.Url) == stemcellFilename {
+			return file, nil
+		}
+	}
+	if strings.HasPrefix(stemcellFilename, "light-") && stemcell.Light != nil {
+		return stemcell.Light, nil
+	}
+	if !strings.HasPrefix(stemcellFilename, "light-") && stemcell.Regular != nil {
+		return stemcell.Regular, nil
+	}
+	return nil, errors.New(fmt.Sprintf("%v lists %v version %v but not %v", baseUrl, stemcellBoshIoName, version, stemcellFilename))
+}
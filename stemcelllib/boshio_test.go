@@ -0,0 +1,276 @@
+package stemcelllib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A local stand-in for bosh.io: the stemcells API, the /d/stemcells
+// redirector and the files it redirects to
+type fakeBoshIo struct {
+	*httptest.Server
+	Versions map[string][]string // bosh.io name -> versions listed
+	Content  []byte              // every stemcell file
+	BadSha   bool                // publish the wrong sha256
+
+	mutex  sync.Mutex
+	ranges []string // Range header of every file GET
+}
+
+func newFakeBoshIo(t *testing.T) *fakeBoshIo {
+	f := &fakeBoshIo{
+		Versions: map[string][]string{},
+		Content:  bytes.Repeat([]byte("stemcell-data-"), 100000),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/stemcells/", f.api)
+	mux.HandleFunc("/d/stemcells/", f.redirect)
+	mux.HandleFunc("/files/", f.file)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+
+	savedUrl := BoshIoUrl
+	BoshIoUrl = f.URL
+	t.Cleanup(func() { BoshIoUrl = savedUrl })
+	return f
+}
+
+// What bosh.io calls the file for a stemcell version
+func testFilename(name string, version string) string {
+	return fmt.Sprintf("bosh-stemcell-%v-%v.tgz", version, strings.TrimPrefix(name, "bosh-"))
+}
+
+func (f *fakeBoshIo) api(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/stemcells/")
+	versions, ok := f.Versions[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	sha := fmt.Sprintf("%x", sha256.Sum256(f.Content))
+	if f.BadSha {
+		sha = strings.Repeat("0", 64)
+	}
+	stemcells := []BoshIoStemcell{}
+	for _, v := range versions {
+		stemcells = append(stemcells, BoshIoStemcell{
+			Name:    name,
+			Version: v,
+			Regular: &BoshIoStemcellFile{Url: f.URL + "/files/" + testFilename(name, v), Size: int64(len(f.Content)), Sha256: sha},
+		})
+	}
+	json.NewEncoder(w).Encode(stemcells)
+}
+
+func (f *fakeBoshIo) redirect(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/d/stemcells/")
+	version := r.URL.Query().Get("v")
+	if _, ok := f.Versions[name]; !ok || version == "" {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/files/"+testFilename(name, version), http.StatusFound)
+}
+
+func (f *fakeBoshIo) file(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		f.mutex.Lock()
+		f.ranges = append(f.ranges, r.Header.Get("Range"))
+		f.mutex.Unlock()
+	}
+	http.ServeContent(w, r, "stemcell.tgz", time.Now(), bytes.NewReader(f.Content))
+}
+
+func (f *fakeBoshIo) Ranges() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.ranges...)
+}
+
+// FetchStemcell downloads into the current directory
+func testChdir(t *testing.T, dir string) {
+	saved, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(saved) })
+}
+
+const (
+	testVsphere   = "bosh-vsphere-esxi-ubuntu-trusty-go_agent"
+	testOpenstack = "bosh-openstack-kvm-ubuntu-trusty-go_agent"
+)
+
+func testSpec(t *testing.T, name string) StemcellSpec {
+	spec, err := ParseBoshIoName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func testVersion(t *testing.T, s string) Version {
+	version, err := ParseVersion(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestResolveVersion(t *testing.T) {
+	f := newFakeBoshIo(t)
+	f.Versions[testVsphere] = []string{"3027", "3026.12", "3026.9", "3026", "2989.1"}
+	f.Versions[testOpenstack] = []string{"3026.12", "3026.9", "3026"}
+
+	for _, tc := range []struct {
+		names []string
+		query string
+		want  string
+	}{
+		{[]string{testVsphere}, "latest", "3027"},
+		{[]string{testVsphere}, "3026.latest", "3026.12"},
+		{[]string{testVsphere}, "2989.latest", "2989.1"},
+		{[]string{testVsphere, testOpenstack}, "3026.latest", "3026.12"},
+		{[]string{testVsphere}, "3026.9", "3026.9"},
+		{[]string{testVsphere}, "1234", "1234"}, // exact versions aren't looked up
+	} {
+		version, err := ResolveVersion(tc.names, tc.query, nil)
+		if err != nil {
+			t.Errorf("%v %v: %v", tc.names, tc.query, err)
+			continue
+		}
+		if version.String() != tc.want {
+			t.Errorf("%v %v: got %v, want %v", tc.names, tc.query, version, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		names []string
+		query string
+	}{
+		{[]string{testVsphere, testOpenstack}, "latest"}, // 3027 vs 3026.12
+		{[]string{testVsphere}, "9999.latest"},
+		{[]string{testVsphere}, "0.latest"}, // not the same as "latest"
+		{[]string{"bosh-warden-boshlite-ubuntu-trusty-go_agent"}, "latest"},
+	} {
+		if version, err := ResolveVersion(tc.names, tc.query, nil); err == nil {
+			t.Errorf("%v %v: got %v, want an error", tc.names, tc.query, version)
+		}
+	}
+}
+
+func TestFetchStemcell(t *testing.T) {
+	f := newFakeBoshIo(t)
+	f.Versions[testVsphere] = []string{"3026.12"}
+	testChdir(t, t.TempDir())
+
+	result, err := FetchStemcell(testSpec(t, testVsphere), testVersion(t, "3026.12"), &FetchOptions{SkipInspect: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := result.StemcellFilename
+	if filename != testFilename(testVsphere, "3026.12") {
+		t.Errorf("got filename %v", filename)
+	}
+	if result.StemcellBytes != len(f.Content) {
+		t.Errorf("got %v bytes, want %v", result.StemcellBytes, len(f.Content))
+	}
+	if result.Sha256 != fmt.Sprintf("%x", sha256.Sum256(f.Content)) {
+		t.Errorf("got sha256 %v", result.Sha256)
+	}
+	if result.Url != f.URL+"/files/"+filename {
+		t.Errorf("got url %v", result.Url)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil || !bytes.Equal(data, f.Content) {
+		t.Errorf("downloaded file doesn't match (%v)", err)
+	}
+	if _, err := os.Stat(filename + partFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("%v%v was left behind", filename, partFileSuffix)
+	}
+}
+
+func TestFetchStemcellResumes(t *testing.T) {
+	f := newFakeBoshIo(t)
+	f.Versions[testVsphere] = []string{"3026"}
+	testChdir(t, t.TempDir())
+	filename := testFilename(testVsphere, "3026")
+	half := len(f.Content) / 2
+	if err := os.WriteFile(filename+partFileSuffix, f.Content[:half], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first progress report says how much was already there
+	var first []float64
+	progress := func(dlnow, dltotal float64) {
+		if first == nil {
+			first = []float64{dlnow, dltotal}
+		}
+	}
+	if _, err := FetchStemcell(testSpec(t, testVsphere), testVersion(t, "3026"), &FetchOptions{SkipInspect: true}, progress); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filename)
+	if !bytes.Equal(data, f.Content) {
+		t.Errorf("resumed file doesn't match")
+	}
+	if len(first) != 2 || first[0] != float64(half) || first[1] != float64(len(f.Content)) {
+		t.Errorf("got first progress %v, want %v of %v", first, half, len(f.Content))
+	}
+	if ranges := f.Ranges(); len(ranges) != 1 || ranges[0] != fmt.Sprintf("bytes=%v-", half) {
+		t.Errorf("got file requests with ranges %q, want one from byte %v", ranges, half)
+	}
+}
+
+func TestFetchStemcellCompletePartFile(t *testing.T) {
+	f := newFakeBoshIo(t)
+	f.Versions[testVsphere] = []string{"3026"}
+	testChdir(t, t.TempDir())
+	filename := testFilename(testVsphere, "3026")
+	if err := os.WriteFile(filename+partFileSuffix, f.Content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server answers 416 for a range past the end, which mustn't start
+	// the download over
+	if _, err := FetchStemcell(testSpec(t, testVsphere), testVersion(t, "3026"), &FetchOptions{SkipInspect: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filename)
+	if !bytes.Equal(data, f.Content) {
+		t.Errorf("file doesn't match")
+	}
+	if ranges := f.Ranges(); len(ranges) != 1 || ranges[0] != fmt.Sprintf("bytes=%v-", len(f.Content)) {
+		t.Errorf("got file requests with ranges %q, want just one from byte %v", ranges, len(f.Content))
+	}
+}
+
+func TestFetchStemcellBadChecksum(t *testing.T) {
+	f := newFakeBoshIo(t)
+	f.BadSha = true
+	f.Versions[testVsphere] = []string{"3026"}
+	testChdir(t, t.TempDir())
+	filename := testFilename(testVsphere, "3026")
+
+	if _, err := FetchStemcell(testSpec(t, testVsphere), testVersion(t, "3026"), &FetchOptions{SkipInspect: true}, nil); err == nil {
+		t.Fatal("got no error for a stemcell that doesn't match its sha256")
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("%v exists after a checksum failure", filename)
+	}
+	if _, err := os.Stat(filename + corruptFileSuffix); err != nil {
+		t.Errorf("no %v%v: %v", filename, corruptFileSuffix, err)
+	}
+}
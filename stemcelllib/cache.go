@@ -0,0 +1,250 @@
+package stemcelllib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Local store of verified stemcells shared across runs.  Files live at
+// <dir>/<bosh.io name>/<version>/<algorithm>-<checksum>/<filename>, where the
+// checksum is the sha256 (or sha1 for older stemcells) bosh.io publishes.
+type Cache struct {
+	Dir string
+}
+
+// One stemcell file in the cache
+type CacheEntry struct {
+	BoshIoName  string
+	Version     Version
+	ChecksumKey string // e.g. "sha256-2f1e..."
+	Filename    string
+	Path        string
+	Size        int64
+	LastUsed    time.Time
+}
+
+func NewCache(dir string) *Cache {
+	return &Cache{Dir: dir}
+}
+
+// $XDG_CACHE_HOME/stemcells, falling back to ~/.cache/stemcells
+func DefaultCacheDir() string {
+	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
+		return filepath.Join(xdg, "stemcells")
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".cache", "stemcells")
+	}
+	return filepath.Join(os.TempDir(), "stemcells-cache")
+}
+
+// Cache key for a published stemcell file; sha256 is preferred
+func checksumKey(published *BoshIoStemcellFile) string {
+	if published.Sha256 != "" {
+		return "sha256-" + strings.ToLower(published.Sha256)
+	}
+	if published.Sha1 != "" {
+		return "sha1-" + strings.ToLower(published.Sha1)
+	}
+	return ""
+}
+
+func (c *Cache) entryPath(stemcellBoshIoName string, version Version, key string, stemcellFilename string) string {
+	return filepath.Join(c.Dir, stemcellBoshIoName, version.String(), key, stemcellFilename)
+}
+
+// Finds a cached copy of a published stemcell file, if there is one of the
+// right size
+func (c *Cache) Lookup(stemcellBoshIoName string, version Version, published *BoshIoStemcellFile, stemcellFilename string) (*CacheEntry, bool) {
+	key := checksumKey(published)
+	if key == "" {
+		return nil, false
+	}
+	path := c.entryPath(stemcellBoshIoName, version, key, stemcellFilename)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, false
+	}
+	if published.Size > 0 && info.Size() != published.Size {
+		return nil, false
+	}
+	return &CacheEntry{
+		BoshIoName:  stemcellBoshIoName,
+		Version:     version,
+		ChecksumKey: key,
+		Filename:    stemcellFilename,
+		Path:        path,
+		Size:        info.Size(),
+		LastUsed:    info.ModTime(),
+	}, true
+}
+
+// Rehashes a cached file and checks it against its key
+func (c *Cache) Verify(entry *CacheEntry) (Checksums, error) {
+	f, err := os.Open(entry.Path)
+	if err != nil {
+		return Checksums{}, err
+	}
+	defer f.Close()
+	h := newStemcellHashes()
+	if _, err := io.Copy(h, f); err != nil {
+		return Checksums{}, err
+	}
+	sums := h.Checksums()
+
+	actual := ""
+	switch {
+	case strings.HasPrefix(entry.ChecksumKey, "sha256-"):
+		actual = "sha256-" + sums.Sha256
+	case strings.HasPrefix(entry.ChecksumKey, "sha1-"):
+		actual = "sha1-" + sums.Sha1
+	}
+	if actual != entry.ChecksumKey {
+		return sums, errors.New(fmt.Sprintf("%v is corrupt (expected %v, got %v)", entry.Path, entry.ChecksumKey, actual))
+	}
+	return sums, nil
+}
+
+// Puts a cached stemcell at destPath, as a hardlink when possible and as a
+// copy otherwise, and marks the entry as used
+func (c *Cache) Use(entry *CacheEntry, destPath string) error {
+	if err := linkOrCopy(entry.Path, destPath); err != nil {
+		return err
+	}
+	now := time.Now()
+	os.Chtimes(entry.Path, now, now)
+	return nil
+}
+
+// Adds a verified stemcell to the cache
+func (c *Cache) Add(stemcellBoshIoName string, version Version, published *BoshIoStemcellFile, stemcellFilename string, srcPath string) error {
+	key := checksumKey(published)
+	if key == "" {
+		return errors.New("no checksum to key the cache entry by")
+	}
+	path := c.entryPath(stemcellBoshIoName, version, key, stemcellFilename)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return linkOrCopy(srcPath, path)
+}
+
+// Everything in the cache, sorted by name and version
+func (c *Cache) Entries() ([]*CacheEntry, error) {
+	entries := []*CacheEntry{}
+	paths, err := filepath.Glob(filepath.Join(c.Dir, "*", "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || strings.HasSuffix(path, partFileSuffix) {
+			continue
+		}
+		keyDir := filepath.Dir(path)
+		versionDir := filepath.Dir(keyDir)
+		nameDir := filepath.Dir(versionDir)
+		version, err := ParseVersion(filepath.Base(versionDir))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, &CacheEntry{
+			BoshIoName:  filepath.Base(nameDir),
+			Version:     version,
+			ChecksumKey: filepath.Base(keyDir),
+			Filename:    filepath.Base(path),
+			Path:        path,
+			Size:        info.Size(),
+			LastUsed:    info.ModTime(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].BoshIoName != entries[j].BoshIoName {
+			return entries[i].BoshIoName < entries[j].BoshIoName
+		}
+		return entries[i].Version.Compare(entries[j].Version) > 0
+	})
+	return entries, nil
+}
+
+// Deletes an entry and any directories it leaves empty
+func (c *Cache) Remove(entry *CacheEntry) error {
+	if err := os.Remove(entry.Path); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(entry.Path); dir != filepath.Clean(c.Dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Removes entries that haven't been used for longer than olderThan (all of
+// them if olderThan is 0) and returns what was removed
+func (c *Cache) Prune(olderThan time.Duration) ([]*CacheEntry, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+	removed := []*CacheEntry{}
+	for _, entry := range entries {
+		if olderThan > 0 && time.Since(entry.LastUsed) < olderThan {
+			continue
+		}
+		if err := c.Remove(entry); err != nil {
+			return removed, err
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+// Hardlinks src to dest, falling back to a copy (e.g., across filesystems).
+// An existing dest is replaced.
+func linkOrCopy(src string, dest string) error {
+	os.Remove(dest)
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".tmp")
+	if err != nil {
+		return err
+	}
+	done := trackInProgress(out.Name())
+	defer done()
+	defer os.Remove(out.Name())
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	os.Chmod(out.Name(), 0644)
+	if err := os.Rename(out.Name(), dest); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(dest))
+	return nil
+}
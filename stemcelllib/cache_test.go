@@ -0,0 +1,139 @@
+package stemcelllib
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A cache in a temporary directory holding one stemcell, and what bosh.io
+// would publish for it
+func testCache(t *testing.T, content string) (*Cache, *BoshIoStemcellFile, *CacheEntry) {
+	c := NewCache(t.TempDir())
+	src := filepath.Join(t.TempDir(), "bosh-stemcell-3026-vsphere-esxi-ubuntu-trusty-go_agent.tgz")
+	if err := ioutil.WriteFile(src, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	published := &BoshIoStemcellFile{Size: int64(len(content)), Sha256: fmt.Sprintf("%x", sha256.Sum256([]byte(content)))}
+	version := testVersion(t, "3026")
+	if err := c.Add(testVsphere, version, published, filepath.Base(src), src); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := c.Lookup(testVsphere, version, published, filepath.Base(src))
+	if !ok {
+		t.Fatal("stemcell wasn't found in the cache after adding it")
+	}
+	return c, published, entry
+}
+
+func TestCacheLookup(t *testing.T) {
+	c, published, entry := testCache(t, "stemcell")
+	wantPath := filepath.Join(c.Dir, testVsphere, "3026", "sha256-"+published.Sha256, entry.Filename)
+	if entry.Path != wantPath || entry.Size != 8 {
+		t.Errorf("got entry %+v, want it at %v", entry, wantPath)
+	}
+
+	// Same name, but not what bosh.io publishes now
+	version := testVersion(t, "3026")
+	for _, other := range []*BoshIoStemcellFile{
+		{Size: published.Size, Sha256: fmt.Sprintf("%x", sha256.Sum256([]byte("other"))), Sha1: "x"},
+		{Size: published.Size + 1, Sha256: published.Sha256},
+		{Size: published.Size},
+	} {
+		if _, ok := c.Lookup(testVsphere, version, other, entry.Filename); ok {
+			t.Errorf("found a cache entry for %+v", other)
+		}
+	}
+}
+
+func TestCacheVerify(t *testing.T) {
+	c, published, entry := testCache(t, "stemcell")
+	sums, err := c.Verify(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums.Sha256 != published.Sha256 {
+		t.Errorf("got sha256 %v, want %v", sums.Sha256, published.Sha256)
+	}
+
+	// Same size, so only rehashing finds it
+	if err := ioutil.WriteFile(entry.Path, []byte("stemcelX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Verify(entry); err == nil {
+		t.Errorf("got no error for a corrupt cache entry")
+	}
+}
+
+func TestCacheUse(t *testing.T) {
+	c, _, entry := testCache(t, "stemcell")
+	dest := filepath.Join(t.TempDir(), entry.Filename)
+	if err := ioutil.WriteFile(dest, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Use(entry, dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(dest); err != nil || string(data) != "stemcell" {
+		t.Errorf("got %q (%v) at %v", data, err, dest)
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	c, published, _ := testCache(t, "stemcell")
+	src := filepath.Join(t.TempDir(), "bosh-stemcell-3026.12-vsphere-esxi-ubuntu-trusty-go_agent.tgz")
+	ioutil.WriteFile(src, []byte("stemcell"), 0644)
+	if err := c.Add(testVsphere, testVersion(t, "3026.12"), published, filepath.Base(src), src); err != nil {
+		t.Fatal(err)
+	}
+	// Neither of these is a stemcell
+	os.MkdirAll(filepath.Join(c.Dir, testVsphere, "not-a-version", "sha256-x"), 0755)
+	ioutil.WriteFile(filepath.Join(c.Dir, testVsphere, "not-a-version", "sha256-x", "x.tgz"), nil, 0644)
+	os.MkdirAll(filepath.Join(c.Dir, testVsphere, "3025", "sha256-y"), 0755)
+	ioutil.WriteFile(filepath.Join(c.Dir, testVsphere, "3025", "sha256-y", "y.tgz"+partFileSuffix), nil, 0644)
+
+	entries, err := c.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Version.String() != "3026.12" || entries[1].Version.String() != "3026" {
+		t.Errorf("got %v entries, want 3026.12 then 3026", len(entries))
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	c, published, old := testCache(t, "stemcell")
+	src := filepath.Join(t.TempDir(), "bosh-stemcell-3027-vsphere-esxi-ubuntu-trusty-go_agent.tgz")
+	ioutil.WriteFile(src, []byte("stemcell"), 0644)
+	if err := c.Add(testVsphere, testVersion(t, "3027"), published, filepath.Base(src), src); err != nil {
+		t.Fatal(err)
+	}
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	os.Chtimes(old.Path, lastWeek, lastWeek)
+
+	removed, err := c.Prune(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Path != old.Path {
+		t.Errorf("got removed %+v, want only %v", removed, old.Path)
+	}
+	if _, err := os.Stat(filepath.Join(c.Dir, testVsphere, "3026")); !os.IsNotExist(err) {
+		t.Errorf("pruning left the 3026 directory behind")
+	}
+
+	// 0 prunes everything
+	if removed, err := c.Prune(0); err != nil || len(removed) != 1 {
+		t.Errorf("got %v removed (%v), want 1", len(removed), err)
+	}
+	if entries, _ := c.Entries(); len(entries) != 0 {
+		t.Errorf("got %v entries after pruning everything", len(entries))
+	}
+	if _, err := os.Stat(c.Dir); err != nil {
+		t.Errorf("pruning removed the cache directory itself: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package stemcelllib
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Hex checksums of a downloaded stemcell
+type Checksums struct {
+	Md5    string
+	Sha1   string
+	Sha256 string
+}
+
+// Computes md5, sha1 and sha256 in one pass
+type stemcellHashes struct {
+	md5    hash.Hash
+	sha1   hash.Hash
+	sha256 hash.Hash
+}
+
+func newStemcellHashes() *stemcellHashes {
+	return &stemcellHashes{md5: md5.New(), sha1: sha1.New(), sha256: sha256.New()}
+}
+
+func (h *stemcellHashes) Write(buf []byte) (int, error) {
+	h.md5.Write(buf)
+	h.sha1.Write(buf)
+	h.sha256.Write(buf)
+	return len(buf), nil
+}
+
+func (h *stemcellHashes) Reset() {
+	h.md5.Reset()
+	h.sha1.Reset()
+	h.sha256.Reset()
+}
+
+func (h *stemcellHashes) Checksums() Checksums {
+	return Checksums{
+		Md5:    fmt.Sprintf("%x", h.md5.Sum(nil)),
+		Sha1:   fmt.Sprintf("%x", h.sha1.Sum(nil)),
+		Sha256: fmt.Sprintf("%x", h.sha256.Sum(nil)),
+	}
+}
+
+// Compares against what bosh.io publishes.  Every checksum bosh.io has is
+// checked, and at least one of sha1/sha256 must be there.
+func (sums Checksums) Verify(published *BoshIoStemcellFile) error {
+	if published.Sha1 == "" && published.Sha256 == "" {
+		return errors.New("bosh.io publishes no sha1 or sha256 to check against")
+	}
+	var mismatches []string
+	check := func(kind, expected, actual string) {
+		if expected != "" && !strings.EqualFold(expected, actual) {
+			mismatches = append(mismatches, fmt.Sprintf("%v expected %v, got %v", kind, expected, actual))
+		}
+	}
+	check("sha256", published.Sha256, sums.Sha256)
+	check("sha1", published.Sha1, sums.Sha1)
+	check("md5", published.Md5, sums.Md5)
+	if len(mismatches) > 0 {
+		return errors.New("checksum mismatch: " + strings.Join(mismatches, "; "))
+	}
+	return nil
+}
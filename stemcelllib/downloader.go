@@ -0,0 +1,101 @@
+package stemcelllib
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/mgoelzer/stemcells/httplib"
+)
+
+// Does the HTTP work of fetching stemcells, so it can be replaced with a fake
+type Downloader interface {
+	// Returns where a URL redirects to, without following the redirect
+	Resolve(url string) (location string, err error)
+
+	// GETs a URL, following redirects.  If offset > 0, asks for the bytes
+	// from offset on with a Range header; the caller must check whether the
+	// server honored it (206) or sent everything (200).
+	Get(url string, offset int64) (*http.Response, error)
+
+	// HEADs a URL, following redirects
+	Head(url string) (*http.Response, error)
+}
+
+// Downloader built on net/http.  Network errors, 429s and 5xxs are retried
+// according to Retry.
+type HttpDownloader struct {
+	Client *http.Client
+	Retry  *httplib.RetryPolicy // nil for httplib.DefaultRetryPolicy
+}
+
+// Used when FetchOptions doesn't name a Downloader
+var DefaultDownloader Downloader = NewHttpDownloader(httplib.NewClient())
+
+func NewHttpDownloader(client *http.Client) *HttpDownloader {
+	return &HttpDownloader{Client: client}
+}
+
+func (d *HttpDownloader) Resolve(url string) (string, error) {
+	// Same connections, but stop at the first redirect
+	noFollow := *d.Client
+	noFollow.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := d.Retry.OrDefault().Do(url, func() (*http.Response, error) {
+		return noFollow.Get(url)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("no redirect from " + url + " (" + resp.Status + ")")
+	}
+	// Location may be relative to the URL asked for
+	if u, err := resp.Request.URL.Parse(location); err == nil {
+		location = u.String()
+	}
+	return location, nil
+}
+
+func (d *HttpDownloader) Get(url string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Checksums are of the bytes as published, never a re-encoding
+	req.Header.Set("Accept-Encoding", "identity")
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	return d.Retry.OrDefault().Do(url, func() (*http.Response, error) {
+		return d.Client.Do(req)
+	})
+}
+
+func (d *HttpDownloader) Head(url string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	return d.Retry.OrDefault().Do(url, func() (*http.Response, error) {
+		return d.Client.Do(req)
+	})
+}
+
+// Every URL a response was redirected through, starting with the one asked
+// for and ending with the one that answered
+func redirectChain(resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req != nil; {
+		chain = append([]string{req.URL.String()}, chain...)
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+	return chain
+}
@@ -0,0 +1,187 @@
+package stemcelllib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// What fetching a stemcell would do, found out without downloading it
+type PlannedFetch struct {
+	StemcellBoshIoName string
+	Flavor             string
+	Version            Version
+	Source             string
+	StemcellFilename   string
+	Path               string   // where it would be written
+	RedirectChain      []string // from the first URL asked for to the file itself
+	Size               int64    // Content-Length, or -1 if unknown
+	PublishedSize      int64    // size the source publishes, or 0
+	Present            bool     // a file is already at Path (and would be replaced)
+	PartialBytes       int64    // how much of a .part file there is to resume
+	Cached             bool     // the cache has it
+	Err                error
+}
+
+// Name plus flavor, as in StemcellSpec.Label
+func (plan PlannedFetch) Label() string {
+	if plan.Flavor == "" {
+		return plan.StemcellBoshIoName
+	}
+	return fmt.Sprintf("%v (%v)", plan.StemcellBoshIoName, plan.Flavor)
+}
+
+// How many bytes a real fetch would download
+func (plan PlannedFetch) BytesToDownload() int64 {
+	if plan.Err != nil || plan.Cached || plan.Size < 0 {
+		return 0
+	}
+	return plan.Size - plan.PartialBytes
+}
+
+// Does what FetchStemcell does up to the download: resolves the filename
+// (the redirect without following it) and HEADs the file, from the first
+// source that works.  Nothing is written.
+func PlanFetch(spec StemcellSpec, version Version, opts *FetchOptions) (plan PlannedFetch) {
+	if opts == nil {
+		opts = &FetchOptions{}
+	}
+	plan.StemcellBoshIoName = spec.BoshIoName()
+	plan.Flavor = spec.Flavor
+	plan.Version = version
+	plan.Size = -1
+
+	sources := opts.sources()
+	var errs []string
+	for _, source := range sources {
+		err := planFromSource(source, spec, version, opts, &plan)
+		if err == nil {
+			return
+		}
+		if len(sources) > 1 {
+			err = errors.New(fmt.Sprintf("%v: %v", source, err))
+		}
+		errs = append(errs, err.Error())
+	}
+	plan.Err = errors.New(strings.Join(errs, "; "))
+	return
+}
+
+func planFromSource(source Source, spec StemcellSpec, version Version, opts *FetchOptions, plan *PlannedFetch) error {
+	loc, err := source.Locate(spec, version, opts)
+	if err != nil {
+		return err
+	}
+	if spec.Flavor == FlavorLight && !strings.HasPrefix(loc.Filename, "light-") {
+		return errors.New(fmt.Sprintf("no light stemcell for %v version %v (got %v)", spec.BoshIoName(), version, loc.Filename))
+	}
+	head, err := source.Head(loc, opts)
+	if err != nil {
+		return err
+	}
+
+	localPath, err := opts.localPath(spec, version, loc.Filename)
+	if err != nil {
+		return err
+	}
+
+	plan.Source = source.String()
+	plan.StemcellFilename = loc.Filename
+	plan.Path = localPath
+	plan.RedirectChain = head.RedirectChain
+	plan.Size = head.Size
+	plan.PublishedSize = loc.Published.Size
+	if plan.Size < 0 && plan.PublishedSize > 0 {
+		plan.Size = plan.PublishedSize
+	}
+
+	if info, err := os.Stat(localPath); err == nil && info.Mode().IsRegular() {
+		plan.Present = true
+	}
+	if info, err := os.Stat(localPath + partFileSuffix); err == nil && info.Mode().IsRegular() {
+		plan.PartialBytes = info.Size()
+	}
+	if opts.Cache != nil {
+		_, plan.Cached = opts.Cache.Lookup(spec.BoshIoName(), version, loc.Published, loc.Filename)
+	}
+	return nil
+}
+
+// PlanFetch for each spec, `parallel` at a time, in the same order as specs
+func PlanAll(specs []StemcellSpec, version Version, parallel int, opts *FetchOptions) []PlannedFetch {
+	if parallel < 1 {
+		parallel = 1
+	}
+	plans := make([]PlannedFetch, len(specs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				plans[i] = PlanFetch(specs[i], version, opts)
+			}
+		}()
+	}
+	for i := range specs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// The same collisions a real run would hit
+	var claims pathClaims
+	for i := range plans {
+		if plans[i].Err == nil {
+			plans[i].Err = claims.claim(plans[i].Path, plans[i].Label())
+		}
+	}
+	return plans
+}
+
+// Writes out each plan and a total, and returns how many plans failed
+func WritePlans(out io.Writer, plans []PlannedFetch) (failed int) {
+	total := int64(0)
+	for _, plan := range plans {
+		fmt.Fprintf(out, "\n%v\n", plan.Label())
+		if plan.Err != nil {
+			failed++
+			fmt.Fprintf(out, "  ERROR:    %v\n", plan.Err)
+			continue
+		}
+		fmt.Fprintf(out, "  File:     %v\n", plan.StemcellFilename)
+		fmt.Fprintf(out, "  Path:     %v\n", plan.Path)
+		fmt.Fprintf(out, "  Source:   %v\n", plan.Source)
+		for i, u := range plan.RedirectChain {
+			if i == 0 {
+				fmt.Fprintf(out, "  URL:      %v\n", u)
+			} else {
+				fmt.Fprintf(out, "         -> %v\n", u)
+			}
+		}
+		if plan.Size >= 0 {
+			fmt.Fprintf(out, "  Size:     %v bytes\n", plan.Size)
+		} else {
+			fmt.Fprintf(out, "  Size:     unknown\n")
+		}
+		switch {
+		case plan.Cached:
+			fmt.Fprintf(out, "  Status:   cached, nothing to download\n")
+		case plan.PartialBytes > 0:
+			fmt.Fprintf(out, "  Status:   would resume after %v bytes already in %v%v\n", plan.PartialBytes, plan.Path, partFileSuffix)
+		default:
+			fmt.Fprintf(out, "  Status:   would download\n")
+		}
+		if plan.Present {
+			fmt.Fprintf(out, "  Note:     %v already exists and would be replaced\n", plan.Path)
+		}
+		total += plan.BytesToDownload()
+	}
+
+	fmt.Fprintf(out, "\nDry run:  %v stemcells, %v bytes to download\n", len(plans)-failed, total)
+	return
+}
@@ -0,0 +1,110 @@
+package stemcelllib
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPlanFetch(t *testing.T) {
+	f := newFakeBoshIo(t)
+	f.Versions[testVsphere] = []string{"3026"}
+	testChdir(t, t.TempDir())
+	filename := testFilename(testVsphere, "3026")
+	os.WriteFile(filename+partFileSuffix, f.Content[:1000], 0644)
+
+	plan := PlanFetch(testSpec(t, testVsphere), testVersion(t, "3026"), nil)
+	if plan.Err != nil {
+		t.Fatal(plan.Err)
+	}
+	if plan.StemcellFilename != filename || plan.Path != filename {
+		t.Errorf("got filename %v, path %v", plan.StemcellFilename, plan.Path)
+	}
+	wantChain := []string{f.URL + "/d/stemcells/" + testVsphere + "?v=3026", f.URL + "/files/" + filename}
+	if strings.Join(plan.RedirectChain, " ") != strings.Join(wantChain, " ") {
+		t.Errorf("got redirect chain %q, want %q", plan.RedirectChain, wantChain)
+	}
+	if plan.Size != int64(len(f.Content)) || plan.PartialBytes != 1000 || plan.Present {
+		t.Errorf("got size %v, partial %v, present %v", plan.Size, plan.PartialBytes, plan.Present)
+	}
+	if plan.BytesToDownload() != int64(len(f.Content)-1000) {
+		t.Errorf("got %v bytes to download", plan.BytesToDownload())
+	}
+
+	// Nothing is downloaded or written
+	if ranges := f.Ranges(); len(ranges) != 0 {
+		t.Errorf("dry run GETed the file %v times", len(ranges))
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote %v", filename)
+	}
+	if data, _ := os.ReadFile(filename + partFileSuffix); len(data) != 1000 {
+		t.Errorf("dry run changed the .part file")
+	}
+}
+
+func TestPlanFetchFallsBack(t *testing.T) {
+	var log []string
+	mirror := &fakeSource{Name: "mirror", LocateErr: errors.New("not mirrored"), log: &log}
+	broken := &fakeSource{Name: "broken", Content: []byte("stemcell"), OpenErr: errors.New("HTTP 503"), log: &log}
+	upstream := &fakeSource{Name: "upstream", Content: []byte("stemcell"), log: &log}
+	testChdir(t, t.TempDir())
+
+	plan := PlanFetch(testSpec(t, testVsphere), testVersion(t, "3026"), fakeFetchOptions(t, mirror, broken, upstream))
+	if plan.Err != nil {
+		t.Fatal(plan.Err)
+	}
+	want := []string{"locate mirror", "locate broken", "head broken", "locate upstream", "head upstream"}
+	if strings.Join(log, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %q, want %q", log, want)
+	}
+	if plan.Source != "upstream" || plan.Size != 8 {
+		t.Errorf("got source %v, size %v", plan.Source, plan.Size)
+	}
+
+	log = nil
+	plan = PlanFetch(testSpec(t, testVsphere), testVersion(t, "3026"), fakeFetchOptions(t, mirror, broken))
+	if plan.Err == nil || !strings.Contains(plan.Err.Error(), "mirror: not mirrored") || !strings.Contains(plan.Err.Error(), "broken: HTTP 503") {
+		t.Errorf("got error %v, want one from every source", plan.Err)
+	}
+}
+
+func TestWritePlans(t *testing.T) {
+	plans := []PlannedFetch{
+		{
+			StemcellBoshIoName: "bosh-aws-xen-hvm-ubuntu-trusty-go_agent",
+			Flavor:             FlavorLight,
+			Source:             "https://bosh.io",
+			StemcellFilename:   "light-bosh-stemcell-3026-aws-xen-hvm-ubuntu-trusty-go_agent.tgz",
+			Path:               "out/aws/light.tgz",
+			RedirectChain:      []string{"https://bosh.io/d/stemcells/x?v=3026", "https://s3.example.com/light.tgz"},
+			Size:               1000,
+			PartialBytes:       400,
+			Present:            true,
+		},
+		{StemcellBoshIoName: testVsphere, StemcellFilename: "vsphere.tgz", Path: "out/vsphere.tgz", Source: "cache", Size: 5000, Cached: true},
+		{StemcellBoshIoName: testOpenstack, StemcellFilename: "openstack.tgz", Path: "out/openstack.tgz", Source: "mirror", Size: -1},
+		{StemcellBoshIoName: "bosh-warden-boshlite-ubuntu-trusty-go_agent", Size: -1, Err: errors.New("HTTP 404")},
+	}
+	var out bytes.Buffer
+	if failed := WritePlans(&out, plans); failed != 1 {
+		t.Errorf("got %v failed, want 1", failed)
+	}
+	for _, want := range []string{
+		"\nbosh-aws-xen-hvm-ubuntu-trusty-go_agent (light)\n  File:     light-bosh-stemcell-3026-aws-xen-hvm-ubuntu-trusty-go_agent.tgz\n  Path:     out/aws/light.tgz\n",
+		"  URL:      https://bosh.io/d/stemcells/x?v=3026\n         -> https://s3.example.com/light.tgz\n",
+		"  Size:     1000 bytes\n",
+		"  Status:   would resume after 400 bytes already in out/aws/light.tgz.part\n",
+		"  Note:     out/aws/light.tgz already exists and would be replaced\n",
+		"  Status:   cached, nothing to download\n",
+		"  Size:     unknown\n  Status:   would download\n",
+		"\nbosh-warden-boshlite-ubuntu-trusty-go_agent\n  ERROR:    HTTP 404\n",
+		"\nDry run:  3 stemcells, 600 bytes to download\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%v", want, out.String())
+		}
+	}
+}
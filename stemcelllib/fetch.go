@@ -0,0 +1,360 @@
+package stemcelllib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mgoelzer/stemcells/httplib"
+)
+
+// Suffix of the file a stemcell is downloaded into before it is complete
+const partFileSuffix = ".part"
+
+// Suffix a download that fails its checksum check is moved to
+const corruptFileSuffix = ".corrupt"
+
+// Outcome of fetching a single stemcell
+type FetchResult struct {
+	StemcellBoshIoName string
+	Flavor             string
+	Version            Version
+	StemcellFilename   string // upstream filename
+	Path               string // where it was written
+	Source             string // the source that supplied the file
+	Url                string // where the file really came from, after redirects
+	StemcellBytes      int
+	Md5                string
+	Sha1               string
+	Sha256             string
+	Started            time.Time
+	Finished           time.Time
+	FromCache          bool
+	Warnings           []string // problems that didn't stop the fetch
+	Err                error    // only set by FetchAll
+}
+
+// Name plus flavor, as in StemcellSpec.Label
+func (result FetchResult) Label() string {
+	if result.Flavor == "" {
+		return result.StemcellBoshIoName
+	}
+	return fmt.Sprintf("%v (%v)", result.StemcellBoshIoName, result.Flavor)
+}
+
+// Settings shared by every fetch in a run
+type FetchOptions struct {
+	Cache      *Cache     // nil to always download
+	Downloader Downloader // nil for DefaultDownloader
+	Sources    []Source   // tried in order; nil for just bosh.io
+
+	// How often a download that breaks off is resumed; nil for
+	// httplib.DefaultRetryPolicy
+	Retry *httplib.RetryPolicy
+
+	// Shared by all concurrent downloads; nil for httplib.DefaultRateLimiter
+	RateLimiter *httplib.RateLimiter
+
+	// Don't read stemcell.MF to check a download is the stemcell asked for
+	SkipInspect bool
+
+	// Delete the .part files of a failed download, instead of leaving them
+	// for the next run to resume
+	RemovePartial bool
+
+	// Where stemcells are written: OutputDir ("" for the current directory)
+	// plus the path Layout gives (nil for DefaultLayout)
+	OutputDir string
+	Layout    *Layout
+
+	claims pathClaims
+}
+
+// Called from inside the download with the bytes fetched so far and the total
+// expected (dltotal is 0 until the server has told us)
+type ProgressFunc func(dlnow, dltotal float64)
+
+// Fetches one stemcell into opts.OutputDir, laid out by opts.Layout, from the
+// first of opts.Sources that has it, and checks it against the published
+// checksums.  Returns the local path, the number of bytes written and the
+// checksums of the file, along with where and when it was downloaded.
+func FetchStemcell(spec StemcellSpec, version Version, opts *FetchOptions, progress ProgressFunc) (result FetchResult, errRet error) {
+	if opts == nil {
+		opts = &FetchOptions{}
+	}
+
+	// Whatever we got as far as is reported, even on failure
+	result.StemcellBoshIoName = spec.BoshIoName()
+	result.Flavor = spec.Flavor
+	result.Version = version
+	result.Started = time.Now()
+	defer func() {
+		result.Finished = time.Now()
+	}()
+
+	// Sources that fail are reported as warnings if a later one works, e.g.
+	// a half-finished download from a mirror is resumed from the next source.
+	// Sources can name the file differently, so every .part file written on
+	// the way is remembered: once the stemcell is here the others are
+	// useless, and if every source fails they are kept for the next run.
+	sources := opts.sources()
+	base := result
+	partPaths := map[string]bool{}
+	var errs []string
+	for _, source := range sources {
+		result = base
+		result.Source = source.String()
+		err := fetchFromSource(source, spec, version, opts, progress, &result, partPaths)
+		if err == nil {
+			result.Warnings = append(errs, result.Warnings...)
+			removePartFiles(partPaths)
+			return
+		}
+		if len(sources) > 1 {
+			err = errors.New(fmt.Sprintf("%v: %v", source, err))
+		}
+		errs = append(errs, err.Error())
+	}
+	errRet = errors.New(strings.Join(errs, "; "))
+	if opts.RemovePartial {
+		removePartFiles(partPaths)
+	}
+	return
+}
+
+// One attempt at FetchStemcell, from a single source
+func fetchFromSource(source Source, spec StemcellSpec, version Version, opts *FetchOptions, progress ProgressFunc, result *FetchResult, partPaths map[string]bool) (errRet error) {
+	stemcellBoshIoName := spec.BoshIoName()
+	var bytesWritten int
+	var sums Checksums
+	defer func() {
+		result.StemcellBytes = bytesWritten
+		result.Md5 = sums.Md5
+		result.Sha1 = sums.Sha1
+		result.Sha256 = sums.Sha256
+	}()
+
+	loc, err := source.Locate(spec, version, opts)
+	if err != nil {
+		return err
+	}
+	stemcellFilename := loc.Filename
+	published := loc.Published
+	result.StemcellFilename = stemcellFilename
+	result.Url = loc.Url
+	if spec.Flavor == FlavorLight && !strings.HasPrefix(stemcellFilename, "light-") {
+		return errors.New(fmt.Sprintf("no light stemcell for %v version %v (got %v)", stemcellBoshIoName, version, stemcellFilename))
+	}
+
+	stemcellLocalPath, err := opts.localPath(spec, version, stemcellFilename)
+	if err != nil {
+		return err
+	}
+	if err := opts.claims.claim(stemcellLocalPath, spec.Label()); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(stemcellLocalPath), 0755); err != nil {
+		return err
+	}
+	result.Path = stemcellLocalPath
+
+	// A good copy in the cache saves the download
+	if opts.Cache != nil {
+		if entry, ok := opts.Cache.Lookup(stemcellBoshIoName, version, published, stemcellFilename); ok {
+			cachedSums, err := opts.Cache.Verify(entry)
+			if err == nil {
+				if err := opts.Cache.Use(entry, stemcellLocalPath); err != nil {
+					return err
+				}
+				sums = cachedSums
+				bytesWritten = int(entry.Size)
+				result.FromCache = true
+				if progress != nil {
+					progress(float64(entry.Size), float64(entry.Size))
+				}
+				return nil
+			}
+			result.Warnings = append(result.Warnings, fmt.Sprintf("removed bad cache entry: %v", err))
+			opts.Cache.Remove(entry)
+		}
+	}
+
+	// Download into a .part file next to the final name (in the same dir),
+	// picking up where an earlier interrupted run left off
+	partPath := stemcellLocalPath + partFileSuffix
+	f, hash, offset, err := openPartFile(partPath)
+	if err != nil {
+		return err
+	}
+	partPaths[partPath] = true
+	defer f.Close()
+	done := trackInProgress(partPath)
+	defer done()
+
+	// Now fetch the file itself, resuming from where it broke off if the
+	// connection drops
+	retry := opts.Retry.OrDefault()
+	for attempt := 1; ; attempt++ {
+		body, err := source.Open(loc, offset, opts)
+		if err != nil {
+			return err
+		}
+		result.Url = body.Url
+
+		// The source couldn't carry on from the .part file, so it starts over
+		if body.Offset != offset {
+			if err := f.Truncate(0); err != nil {
+				body.Body.Close()
+				return err
+			}
+			hash.Reset()
+			offset = 0
+		}
+
+		// Progress is reported to the caller, which decides how to draw it,
+		// starting with what's already in the .part file so that isn't
+		// counted as downloaded just now
+		dltotal := float64(0)
+		if body.Size > 0 {
+			dltotal = float64(body.Size)
+		}
+		if progress != nil {
+			progress(float64(offset), dltotal)
+		}
+		counter := &progressWriter{dlnow: offset, dltotal: dltotal, progress: progress}
+
+		n, err := io.Copy(io.MultiWriter(f, hash, counter), opts.rateLimiter().Reader(body.Body))
+		body.Body.Close()
+		offset += n
+		bytesWritten = int(offset)
+		if err == nil {
+			break
+		}
+		if attempt >= retry.MaxAttempts {
+			return errors.New(fmt.Sprintf("download of %v failed: %v", stemcellFilename, err))
+		}
+		retry.Wait(stemcellFilename, attempt, nil, err)
+	}
+
+	// On disk before it can be renamed into place
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Anything that doesn't match what was published is moved out of the way
+	// so it can neither be resumed nor mistaken for a good stemcell
+	sums = hash.Checksums()
+	err = sums.Verify(published)
+	if err == nil && published.Size > 0 && int64(bytesWritten) != published.Size {
+		err = errors.New(fmt.Sprintf("size mismatch: expected %v bytes, got %v", published.Size, bytesWritten))
+	}
+	// A file can match its checksums and still be the wrong stemcell, e.g. a
+	// mislabeled mirror, so check it says it's what was asked for
+	if err == nil && !opts.SkipInspect {
+		var info *StemcellInfo
+		if info, err = InspectStemcell(partPath); err == nil {
+			err = info.Check(spec, version)
+		}
+	}
+	if err != nil {
+		corruptPath := stemcellLocalPath + corruptFileSuffix
+		if renameErr := os.Rename(partPath, corruptPath); renameErr != nil {
+			os.Remove(partPath)
+			return errors.New(fmt.Sprintf("%v failed verification (%v) and was deleted", stemcellFilename, err))
+		}
+		return errors.New(fmt.Sprintf("%v failed verification (%v), quarantined as %v", stemcellFilename, err, corruptPath))
+	}
+
+	// Only a complete, verified download gets the real name
+	if err := os.Rename(partPath, stemcellLocalPath); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(stemcellLocalPath))
+
+	if opts.Cache != nil {
+		if err := opts.Cache.Add(stemcellBoshIoName, version, published, stemcellFilename, stemcellLocalPath); err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("couldn't add %v to the cache: %v", stemcellFilename, err))
+		}
+	}
+	return nil
+}
+
+func (opts *FetchOptions) sources() []Source {
+	if opts == nil || len(opts.Sources) == 0 {
+		return []Source{NewBoshIoSource(BoshIoUrl)}
+	}
+	return opts.Sources
+}
+
+func (opts *FetchOptions) rateLimiter() *httplib.RateLimiter {
+	if opts == nil || opts.RateLimiter == nil {
+		return httplib.DefaultRateLimiter
+	}
+	return opts.RateLimiter
+}
+
+func (opts *FetchOptions) downloader() Downloader {
+	if opts == nil || opts.Downloader == nil {
+		return DefaultDownloader
+	}
+	return opts.Downloader
+}
+
+// Last path element of a URL, ignoring any query string
+func filenameFromUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	filename := path.Base(u.Path)
+	if filename == "." || filename == "/" {
+		return ""
+	}
+	return filename
+}
+
+// Counts bytes as they are written and passes them on to a ProgressFunc
+type progressWriter struct {
+	dlnow    int64
+	dltotal  float64
+	progress ProgressFunc
+}
+
+func (w *progressWriter) Write(buf []byte) (int, error) {
+	w.dlnow += int64(len(buf))
+	if w.progress != nil {
+		w.progress(float64(w.dlnow), w.dltotal)
+	}
+	return len(buf), nil
+}
+
+// Deletes whatever .part files are still there
+func removePartFiles(partPaths map[string]bool) {
+	for partPath := range partPaths {
+		os.Remove(partPath)
+	}
+}
+
+// Opens (or creates) a .part file for appending, and returns it along with
+// hashes already fed with whatever bytes are in it
+func openPartFile(partPath string) (f *os.File, h *stemcellHashes, offset int64, err error) {
+	f, err = os.OpenFile(partPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	h = newStemcellHashes()
+	if offset, err = io.Copy(h, f); err != nil {
+		f.Close()
+		return
+	}
+	return
+}
@@ -0,0 +1,457 @@
+package stemcelllib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mgoelzer/stemcells/httplib"
+)
+
+// An in-memory Source that can be told to fail, and records what was asked
+// of it in a log shared with the other sources of a test
+type fakeSource struct {
+	Name      string
+	Filename  string // "" for the bosh.io filename
+	Content   []byte
+	LocateErr error
+	OpenErr   error
+	BreakAt   int64 // if > 0, the body fails after this many bytes
+
+	log *[]string
+}
+
+func (s *fakeSource) String() string {
+	return s.Name
+}
+
+func (s *fakeSource) Locate(spec StemcellSpec, version Version, opts *FetchOptions) (*LocatedStemcell, error) {
+	*s.log = append(*s.log, "locate "+s.Name)
+	if s.LocateErr != nil {
+		return nil, s.LocateErr
+	}
+	filename := s.Filename
+	if filename == "" {
+		filename = spec.Filename(version)
+	}
+	published := &BoshIoStemcellFile{Sha256: fmt.Sprintf("%x", sha256.Sum256(s.Content)), Size: int64(len(s.Content))}
+	return &LocatedStemcell{Filename: filename, Url: "fake://" + s.Name + "/" + filename, Published: published}, nil
+}
+
+func (s *fakeSource) Open(loc *LocatedStemcell, offset int64, opts *FetchOptions) (*OpenedStemcell, error) {
+	*s.log = append(*s.log, fmt.Sprintf("open %v from %v", s.Name, offset))
+	if s.OpenErr != nil {
+		return nil, s.OpenErr
+	}
+	var body io.Reader = bytes.NewReader(s.Content[offset:])
+	if s.BreakAt > offset {
+		body = io.MultiReader(bytes.NewReader(s.Content[offset:s.BreakAt]), &failingReader{})
+	}
+	return &OpenedStemcell{Body: ioutil.NopCloser(body), Offset: offset, Size: int64(len(s.Content)), Url: loc.Url}, nil
+}
+
+func (s *fakeSource) Head(loc *LocatedStemcell, opts *FetchOptions) (*StemcellHead, error) {
+	*s.log = append(*s.log, "head "+s.Name)
+	if s.OpenErr != nil {
+		return nil, s.OpenErr
+	}
+	return &StemcellHead{RedirectChain: []string{loc.Url}, Size: int64(len(s.Content))}, nil
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read(buf []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// Options that never wait between retries and only try each source once
+func fakeFetchOptions(t *testing.T, sources ...Source) *FetchOptions {
+	return &FetchOptions{
+		Sources:     sources,
+		SkipInspect: true,
+		Retry:       &httplib.RetryPolicy{MaxAttempts: 1, Logf: t.Logf},
+	}
+}
+
+func TestFetchStemcellFallsBack(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1000)
+	var log []string
+	mirror := &fakeSource{Name: "mirror", LocateErr: errors.New("not mirrored"), log: &log}
+	broken := &fakeSource{Name: "broken", Content: content, OpenErr: errors.New("HTTP 503"), log: &log}
+	upstream := &fakeSource{Name: "upstream", Content: content, log: &log}
+	unused := &fakeSource{Name: "unused", Content: content, log: &log}
+	opts := fakeFetchOptions(t, mirror, broken, upstream, unused)
+	testChdir(t, t.TempDir())
+
+	result, err := FetchStemcell(testSpec(t, testVsphere), testVersion(t, "3026"), opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"locate mirror", "locate broken", "open broken from 0", "locate upstream", "open upstream from 0"}
+	if strings.Join(log, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got calls %q, want %q", log, want)
+	}
+	if result.Source != "upstream" {
+		t.Errorf("got source %v, want upstream", result.Source)
+	}
+	if len(result.Warnings) != 2 || !strings.Contains(result.Warnings[0], "mirror: not mirrored") || !strings.Contains(result.Warnings[1], "broken: HTTP 503") {
+		t.Errorf("got warnings %q", result.Warnings)
+	}
+	if data, _ := ioutil.ReadFile(result.StemcellFilename); !bytes.Equal(data, content) {
+		t.Errorf("fetched file doesn't match")
+	}
+}
+
+func TestFetchStemcellResumesFromNextSource(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	var log []string
+	first := &fakeSource{Name: "first", Content: content, BreakAt: 400, log: &log}
+	second := &fakeSource{Name: "second", Content: content, log: &log}
+	testChdir(t, t.TempDir())
+
+	result, err := FetchStemcell(testSpec(t, testVsphere), testVersion(t, "3026"), fakeFetchOptions(t, first, second), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log[len(log)-1] != "open second from 400" {
+		t.Errorf("second source wasn't asked to resume: %q", log)
+	}
+	if data, _ := ioutil.ReadFile(result.StemcellFilename); !bytes.Equal(data, content) {
+		t.Errorf("resumed file doesn't match")
+	}
+}
+
+func TestFetchStemcellKeepsPartFiles(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	var log []string
+	spec := testSpec(t, testVsphere)
+	version := testVersion(t, "3026")
+	mirror := &fakeSource{Name: "mirror", Filename: "mirrored.tgz", Content: content, BreakAt: 200, log: &log}
+	upstream := &fakeSource{Name: "upstream", Content: content, BreakAt: 300, log: &log}
+	opts := fakeFetchOptions(t, mirror, upstream)
+	testChdir(t, t.TempDir())
+	mirrorPart := "mirrored.tgz" + partFileSuffix
+	upstreamPart := spec.Filename(version) + partFileSuffix
+
+	// Both break off, and both .part files are left to resume
+	if _, err := FetchStemcell(spec, version, opts, nil); err == nil {
+		t.Fatal("got no error when every source failed")
+	}
+	for _, path := range []string{mirrorPart, upstreamPart} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%v wasn't kept: %v", path, err)
+		}
+	}
+
+	// Once upstream works, the mirror's .part file is no use
+	mirror.OpenErr = errors.New("mirror is down")
+	upstream.BreakAt = 0
+	opts = fakeFetchOptions(t, mirror, upstream)
+	log = nil
+	if _, err := FetchStemcell(spec, version, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if log[len(log)-1] != "open upstream from 300" {
+		t.Errorf("upstream wasn't resumed: %q", log)
+	}
+	for _, path := range []string{mirrorPart, upstreamPart} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%v was left behind", path)
+		}
+	}
+}
+
+func TestFetchStemcellRemovePartial(t *testing.T) {
+	var log []string
+	spec := testSpec(t, testVsphere)
+	version := testVersion(t, "3026")
+	opts := fakeFetchOptions(t, &fakeSource{Name: "upstream", Content: []byte("0123456789"), BreakAt: 5, log: &log})
+	opts.RemovePartial = true
+	testChdir(t, t.TempDir())
+
+	if _, err := FetchStemcell(spec, version, opts, nil); err == nil {
+		t.Fatal("got no error for a broken download")
+	}
+	partPath := spec.Filename(version) + partFileSuffix
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Errorf("%v wasn't removed", partPath)
+	}
+}
+
+func TestAbortInProgress(t *testing.T) {
+	dir := t.TempDir()
+	partPath := filepath.Join(dir, "stemcell.tgz"+partFileSuffix)
+	tmpPath := filepath.Join(dir, "stemcells.json.tmp123")
+	for _, path := range []string{partPath, tmpPath} {
+		os.WriteFile(path, []byte("half"), 0644)
+		defer trackInProgress(path)()
+	}
+
+	removed, kept := AbortInProgress(false)
+	if len(removed) != 1 || removed[0] != tmpPath || len(kept) != 1 || kept[0] != partPath {
+		t.Errorf("got removed %q, kept %q", removed, kept)
+	}
+	if _, err := os.Stat(partPath); err != nil {
+		t.Errorf("%v wasn't kept: %v", partPath, err)
+	}
+
+	trackInProgress(partPath)
+	if removed, _ := AbortInProgress(true); len(removed) != 1 || removed[0] != partPath {
+		t.Errorf("got removed %q, want the .part file", removed)
+	}
+}
+
+func TestFetchStemcellReportsEverySource(t *testing.T) {
+	var log []string
+	opts := fakeFetchOptions(t,
+		&fakeSource{Name: "a", LocateErr: errors.New("not found"), log: &log},
+		&fakeSource{Name: "b", Content: []byte("data"), OpenErr: errors.New("refused"), log: &log})
+	testChdir(t, t.TempDir())
+
+	_, err := FetchStemcell(testSpec(t, testVsphere), testVersion(t, "3026"), opts, nil)
+	if err == nil {
+		t.Fatal("got no error when every source failed")
+	}
+	for _, want := range []string{"a: not found", "b: refused"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
+
+// A Downloader serving redirects and files from memory, with Range support
+type fakeDownloader struct {
+	Redirects map[string]string
+	Files     map[string][]byte
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (d *fakeDownloader) record(method string, url string, offset int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.requests = append(d.requests, fmt.Sprintf("%v %v %v", method, url, offset))
+}
+
+func (d *fakeDownloader) Resolve(url string) (string, error) {
+	d.record("RESOLVE", url, 0)
+	if location, ok := d.Redirects[url]; ok {
+		return location, nil
+	}
+	return "", errors.New("no redirect from " + url)
+}
+
+func (d *fakeDownloader) Get(url string, offset int64) (*http.Response, error) {
+	d.record("GET", url, offset)
+	return d.respond("GET", url, offset)
+}
+
+func (d *fakeDownloader) Head(url string) (*http.Response, error) {
+	d.record("HEAD", url, 0)
+	return d.respond("HEAD", url, 0)
+}
+
+func (d *fakeDownloader) respond(method string, url string, offset int64) (*http.Response, error) {
+	if location, ok := d.Redirects[url]; ok {
+		url = location
+	}
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := &http.Response{Request: req, Header: http.Header{}, StatusCode: http.StatusOK, Status: "200 OK"}
+	data, ok := d.Files[url]
+	if !ok {
+		resp.StatusCode, resp.Status = http.StatusNotFound, "404 Not Found"
+		data = nil
+	} else if offset > 0 {
+		resp.StatusCode, resp.Status = http.StatusPartialContent, "206 Partial Content"
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", offset, len(data)-1, len(data)))
+		data = data[offset:]
+	}
+	resp.ContentLength = int64(len(data))
+	if method == "HEAD" {
+		data = nil
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+// bosh.io as seen through a fakeDownloader, publishing one stemcell
+func testDownloader(t *testing.T, name string, version string, content []byte) (*fakeDownloader, string) {
+	savedUrl := BoshIoUrl
+	BoshIoUrl = "http://bosh.example.com"
+	t.Cleanup(func() { BoshIoUrl = savedUrl })
+
+	filename := testFilename(name, version)
+	fileUrl := "http://files.example.com/" + filename
+	api, err := json.Marshal([]BoshIoStemcell{{
+		Name:    name,
+		Version: version,
+		Regular: &BoshIoStemcellFile{Url: fileUrl, Size: int64(len(content)), Sha256: fmt.Sprintf("%x", sha256.Sum256(content))},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDownloader{
+		Redirects: map[string]string{BoshIoUrl + "/d/stemcells/" + name + "?v=" + version: fileUrl},
+		Files: map[string][]byte{
+			BoshIoUrl + "/api/v1/stemcells/" + name: api,
+			fileUrl:                                 content,
+		},
+	}
+	return d, fileUrl
+}
+
+func TestFetchStemcellWithDownloader(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	d, fileUrl := testDownloader(t, testVsphere, "3026", content)
+	testChdir(t, t.TempDir())
+	filename := testFilename(testVsphere, "3026")
+
+	// Half a download left by an earlier run
+	if err := ioutil.WriteFile(filename+partFileSuffix, content[:3000], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := FetchStemcell(testSpec(t, testVsphere), testVersion(t, "3026"), &FetchOptions{Downloader: d, SkipInspect: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Url != fileUrl || result.StemcellBytes != len(content) {
+		t.Errorf("got %v bytes from %v", result.StemcellBytes, result.Url)
+	}
+	if data, _ := ioutil.ReadFile(filename); !bytes.Equal(data, content) {
+		t.Errorf("fetched file doesn't match")
+	}
+	want := "GET " + fileUrl + " 3000"
+	if last := d.requests[len(d.requests)-1]; last != want {
+		t.Errorf("got last request %q, want %q", last, want)
+	}
+}
+
+func TestFetchStemcellUsesCache(t *testing.T) {
+	content := bytes.Repeat([]byte("cached"), 500)
+	d, fileUrl := testDownloader(t, testVsphere, "3026", content)
+	testChdir(t, t.TempDir())
+	opts := &FetchOptions{Downloader: d, Cache: NewCache(t.TempDir()), SkipInspect: true}
+	version := testVersion(t, "3026")
+
+	if result, err := FetchStemcell(testSpec(t, testVsphere), version, opts, nil); err != nil || result.FromCache {
+		t.Fatalf("first fetch: %v (from cache %v)", err, result.FromCache)
+	}
+
+	// The second run still asks bosh.io what to expect, but can't download
+	os.Remove(testFilename(testVsphere, "3026"))
+	delete(d.Files, fileUrl)
+	result, err := FetchStemcell(testSpec(t, testVsphere), version, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.FromCache {
+		t.Errorf("second fetch didn't come from the cache")
+	}
+	if data, _ := ioutil.ReadFile(result.StemcellFilename); !bytes.Equal(data, content) {
+		t.Errorf("file from the cache doesn't match")
+	}
+}
+
+func TestFetchStemcellReplacesBadCacheEntry(t *testing.T) {
+	content := bytes.Repeat([]byte("cached"), 500)
+	d, _ := testDownloader(t, testVsphere, "3026", content)
+	testChdir(t, t.TempDir())
+	opts := &FetchOptions{Downloader: d, Cache: NewCache(t.TempDir()), SkipInspect: true}
+	version := testVersion(t, "3026")
+	if _, err := FetchStemcell(testSpec(t, testVsphere), version, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the cached copy (the fetched file is a hardlink to it, so
+	// replace rather than overwrite)
+	entries, _ := opts.Cache.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("got %v cache entries, want 1", len(entries))
+	}
+	os.Remove(entries[0].Path)
+	ioutil.WriteFile(entries[0].Path, bytes.Repeat([]byte("X"), len(content)), 0644)
+
+	result, err := FetchStemcell(testSpec(t, testVsphere), version, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FromCache || len(result.Warnings) != 1 {
+		t.Errorf("got from cache %v, warnings %q", result.FromCache, result.Warnings)
+	}
+	if data, _ := ioutil.ReadFile(entries[0].Path); !bytes.Equal(data, content) {
+		t.Errorf("bad cache entry wasn't replaced")
+	}
+}
+
+func TestFetchStemcellFromHttpDir(t *testing.T) {
+	spec := testSpec(t, testVsphere)
+	version := testVersion(t, "3026")
+	filename := spec.Filename(version)
+	content := bytes.Repeat([]byte("mirrored"), 1000)
+	d := &fakeDownloader{Files: map[string][]byte{
+		"http://mirror/stemcells/" + filename:             content,
+		"http://mirror/stemcells/" + filename + ".sha256": []byte(fmt.Sprintf("%x  %v\n", sha256.Sum256(content), filename)),
+	}}
+	opts := fakeFetchOptions(t, NewHttpDirSource("http://mirror/stemcells"))
+	opts.Downloader = d
+	testChdir(t, t.TempDir())
+
+	// Half a download left by an earlier run
+	if err := ioutil.WriteFile(filename+partFileSuffix, content[:3000], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := FetchStemcell(spec, version, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(result.StemcellFilename); !bytes.Equal(data, content) {
+		t.Errorf("fetched file doesn't match")
+	}
+	want := "GET http://mirror/stemcells/" + filename + " 3000"
+	if last := d.requests[len(d.requests)-1]; last != want {
+		t.Errorf("got last request %q, want %q", last, want)
+	}
+}
+
+func TestHttpDirSourceLocate(t *testing.T) {
+	spec := testSpec(t, testVsphere)
+	version := testVersion(t, "3026")
+	filename := spec.Filename(version)
+	d := &fakeDownloader{Files: map[string][]byte{
+		"http://bucket/" + filename:           []byte("data"),
+		"http://bucket/" + filename + ".sha1": []byte("deadbeef"),
+	}}
+	opts := &FetchOptions{Downloader: d}
+	source := NewHttpDirSource("http://bucket/")
+
+	loc, err := source.Locate(spec, version, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Url != "http://bucket/"+filename || loc.Published.Sha1 != "deadbeef" {
+		t.Errorf("got %v with sha1 %v", loc.Url, loc.Published.Sha1)
+	}
+	if d.requests[0] != "HEAD http://bucket/"+filename+" 0" {
+		t.Errorf("got first request %q, want a HEAD of the file", d.requests[0])
+	}
+
+	if _, err := source.Locate(spec, testVersion(t, "3027"), opts); err == nil || !strings.Contains(err.Error(), "is not in http://bucket") {
+		t.Errorf("got %v for a missing stemcell", err)
+	}
+}
@@ -0,0 +1,188 @@
+package stemcelllib
+
+// Must install yaml:  go get -u gopkg.in/yaml.v2
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// What a stemcell says about itself in the stemcell.MF at the top of its
+// tarball
+type StemcellMetadata struct {
+	Name            string                 `json:"name" yaml:"name"`
+	Version         string                 `json:"version" yaml:"version"`
+	ApiVersion      int                    `json:"api_version,omitempty" yaml:"api_version,omitempty"`
+	BoshProtocol    string                 `json:"bosh_protocol,omitempty" yaml:"bosh_protocol,omitempty"`
+	Sha1            string                 `json:"sha1" yaml:"sha1"`
+	OperatingSystem string                 `json:"operating_system" yaml:"operating_system"`
+	StemcellFormats []string               `json:"stemcell_formats,omitempty" yaml:"stemcell_formats,omitempty"`
+	CloudProperties map[string]interface{} `json:"cloud_properties" yaml:"cloud_properties"`
+}
+
+// Reads a string out of cloud_properties, or "" if it isn't there
+func (m *StemcellMetadata) CloudProperty(key string) string {
+	if v, ok := m.CloudProperties[key]; ok && v != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return ""
+}
+
+// A stemcell tarball's metadata plus what was found checking it
+type StemcellInfo struct {
+	Path        string           `json:"path"`
+	Metadata    StemcellMetadata `json:"stemcell_mf"`
+	ImageSize   int64            `json:"image_size"`
+	ImageSha1   string           `json:"image_sha1"`
+	ImageSha256 string           `json:"image_sha256"`
+	Files       []string         `json:"files"`
+}
+
+// Whether the image in the tarball hashes to what stemcell.MF says.  Newer
+// stemcells may give a "sha256:<hex>" there instead of a plain sha1.
+func (info *StemcellInfo) ImageMatches() bool {
+	expected := info.Metadata.Sha1
+	if strings.HasPrefix(expected, "sha256:") {
+		return strings.EqualFold(strings.TrimPrefix(expected, "sha256:"), info.ImageSha256)
+	}
+	return strings.EqualFold(expected, info.ImageSha1)
+}
+
+// Streams through a stemcell tarball once, reading stemcell.MF and hashing
+// the image next to it
+func InspectStemcell(stemcellPath string) (*StemcellInfo, error) {
+	f, err := os.Open(stemcellPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%v is not a gzipped tarball: %v", stemcellPath, err))
+	}
+	defer gz.Close()
+
+	info := &StemcellInfo{Path: stemcellPath, Files: []string{}}
+	foundManifest, foundImage := false, false
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: bad tarball: %v", stemcellPath, err))
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if header.Typeflag == tar.TypeDir || name == "." {
+			continue
+		}
+		info.Files = append(info.Files, name)
+
+		switch name {
+		case "stemcell.MF":
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			if err := yaml.Unmarshal(data, &info.Metadata); err != nil {
+				return nil, errors.New(fmt.Sprintf("%v: bad stemcell.MF: %v", stemcellPath, err))
+			}
+			info.Metadata.CloudProperties = stringKeys(info.Metadata.CloudProperties).(map[string]interface{})
+			foundManifest = true
+		case "image":
+			h := newStemcellHashes()
+			n, err := io.Copy(h, tr)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%v: can't read image: %v", stemcellPath, err))
+			}
+			sums := h.Checksums()
+			info.ImageSize = n
+			info.ImageSha1 = sums.Sha1
+			info.ImageSha256 = sums.Sha256
+			foundImage = true
+		}
+	}
+	if !foundManifest {
+		return nil, errors.New(fmt.Sprintf("%v has no stemcell.MF", stemcellPath))
+	}
+	if !foundImage {
+		return nil, errors.New(fmt.Sprintf("%v has no image", stemcellPath))
+	}
+	return info, nil
+}
+
+// Checks the tarball is the stemcell that was asked for: name, version, OS
+// and infrastructure in stemcell.MF and its cloud_properties, and the image
+// checksum
+func (info *StemcellInfo) Check(spec StemcellSpec, version Version) error {
+	m := &info.Metadata
+	var mismatches []string
+	check := func(what, expected, actual string) {
+		if expected != "" && actual != expected {
+			mismatches = append(mismatches, fmt.Sprintf("%v is '%v', expected '%v'", what, actual, expected))
+		}
+	}
+	checkVersion := func(what, actual string) {
+		if v, err := ParseVersion(actual); err != nil || !v.Equal(version) {
+			mismatches = append(mismatches, fmt.Sprintf("%v is '%v', expected '%v'", what, actual, version))
+		}
+	}
+
+	check("name", spec.BoshIoName(), m.Name)
+	checkVersion("version", m.Version)
+	check("operating_system", spec.OS, m.OperatingSystem)
+	check("cloud_properties.infrastructure", spec.Iaas, m.CloudProperty("infrastructure"))
+	// Not every stemcell repeats these in cloud_properties
+	if name := m.CloudProperty("name"); name != "" {
+		check("cloud_properties.name", spec.BoshIoName(), name)
+	}
+	// An unquoted version there decodes as a number, and 3026.10 would come
+	// out as 3026.1, so only quoted ones are compared
+	if v, ok := m.CloudProperties["version"].(string); ok {
+		checkVersion("cloud_properties.version", v)
+	}
+	if !info.ImageMatches() {
+		mismatches = append(mismatches, fmt.Sprintf("image doesn't match stemcell.MF's sha1 %v", m.Sha1))
+	}
+
+	if len(mismatches) > 0 {
+		return errors.New(fmt.Sprintf("%v is not %v version %v: %v", path.Base(info.Path), spec.BoshIoName(), version, strings.Join(mismatches, ", ")))
+	}
+	return nil
+}
+
+// yaml.v2 decodes nested maps with interface{} keys, which encoding/json
+// can't handle
+func stringKeys(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range vv {
+			m[fmt.Sprintf("%v", k)] = stringKeys(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range vv {
+			m[k] = stringKeys(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range vv {
+			vv[i] = stringKeys(val)
+		}
+		return vv
+	}
+	return v
+}
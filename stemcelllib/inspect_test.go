@@ -0,0 +1,170 @@
+package stemcelllib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A stemcell tarball holding an image and a stemcell.MF; manifest is
+// formatted with the image's sha1, and either can be left out
+func testStemcellTarball(t *testing.T, manifest string, image []byte) []byte {
+	var mf []byte
+	if manifest != "" {
+		mf = []byte(fmt.Sprintf(manifest, fmt.Sprintf("%x", sha1.Sum(image))))
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"./stemcell.MF", mf},
+		{"./image", image},
+		{"./packages.txt", []byte("openssl 1.0.1f\n")},
+	}
+	tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, file := range files {
+		if file.data == nil {
+			continue
+		}
+		tw.WriteHeader(&tar.Header{Name: file.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file.data))})
+		tw.Write(file.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+const testManifest = `---
+name: bosh-vsphere-esxi-ubuntu-trusty-go_agent
+version: '3026.12'
+bosh_protocol: '1'
+sha1: %v
+operating_system: ubuntu-trusty
+stemcell_formats:
+- vsphere-ovf
+cloud_properties:
+  name: bosh-vsphere-esxi-ubuntu-trusty-go_agent
+  version: '3026.12'
+  infrastructure: vsphere
+  hypervisor: esxi
+  disk: 3072
+`
+
+func testInspect(t *testing.T, manifest string, image []byte) (*StemcellInfo, error) {
+	path := filepath.Join(t.TempDir(), "stemcell.tgz")
+	if err := ioutil.WriteFile(path, testStemcellTarball(t, manifest, image), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return InspectStemcell(path)
+}
+
+func TestInspectStemcell(t *testing.T) {
+	image := []byte("image bytes")
+	info, err := testInspect(t, testManifest, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := info.Metadata
+	if m.Name != testVsphere || m.Version != "3026.12" || m.OperatingSystem != "ubuntu-trusty" || m.CloudProperty("infrastructure") != "vsphere" {
+		t.Errorf("got metadata %+v", m)
+	}
+	if m.CloudProperty("disk") != "3072" || m.CloudProperty("missing") != "" {
+		t.Errorf("got disk %q, missing %q", m.CloudProperty("disk"), m.CloudProperty("missing"))
+	}
+	if info.ImageSize != int64(len(image)) || info.ImageSha256 != fmt.Sprintf("%x", sha256.Sum256(image)) || !info.ImageMatches() {
+		t.Errorf("got image of %v bytes, sha256 %v", info.ImageSize, info.ImageSha256)
+	}
+	if strings.Join(info.Files, ",") != "stemcell.MF,image,packages.txt" {
+		t.Errorf("got files %q", info.Files)
+	}
+}
+
+func TestInspectStemcellErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"not gzipped", []byte("<html>Not Found</html>"), "not a gzipped tarball"},
+		{"no manifest", testStemcellTarball(t, "", []byte("image")), "has no stemcell.MF"},
+		{"no image", testStemcellTarball(t, testManifest, nil), "has no image"},
+		{"bad manifest", testStemcellTarball(t, "name: [%v", []byte("image")), "bad stemcell.MF"},
+	} {
+		path := filepath.Join(t.TempDir(), "stemcell.tgz")
+		ioutil.WriteFile(path, tc.content, 0644)
+		if _, err := InspectStemcell(path); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: got error %v, want one saying %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	image := []byte("image bytes")
+	spec := testSpec(t, testVsphere)
+	version := testVersion(t, "3026.12")
+	for _, tc := range []struct {
+		name     string
+		manifest string
+		want     string // "" for no mismatch
+	}{
+		{"match", testManifest, ""},
+		{"unquoted cloud_properties version", strings.Replace(testManifest, "  version: '3026.12'", "  version: 3026.12", 1), ""},
+		{"sha256 image checksum", strings.Replace(testManifest, "sha1: %v", fmt.Sprintf("sha1: sha256:%x%%.0v", sha256.Sum256(image)), 1), ""},
+		{"no name in cloud_properties", strings.Replace(testManifest, "  name: bosh-vsphere-esxi-ubuntu-trusty-go_agent\n", "", 1), ""},
+		{"name", strings.Replace(testManifest, "name: bosh-vsphere-esxi-ubuntu-trusty-go_agent\nversion", "name: bosh-aws-xen-hvm-ubuntu-trusty-go_agent\nversion", 1), "name is 'bosh-aws-xen-hvm-ubuntu-trusty-go_agent'"},
+		{"version", strings.Replace(testManifest, "version: '3026.12'\nbosh", "version: '3026.1'\nbosh", 1), "version is '3026.1', expected '3026.12'"},
+		{"quoted cloud_properties version", strings.Replace(testManifest, "  version: '3026.12'", "  version: '3026.11'", 1), "cloud_properties.version is '3026.11'"},
+		{"os", strings.Replace(testManifest, "operating_system: ubuntu-trusty", "operating_system: ubuntu-xenial", 1), "operating_system is 'ubuntu-xenial'"},
+		{"infrastructure", strings.Replace(testManifest, "infrastructure: vsphere", "infrastructure: vcloud", 1), "cloud_properties.infrastructure is 'vcloud'"},
+		{"cloud_properties name", strings.Replace(testManifest, "  name: bosh-vsphere-esxi-ubuntu-trusty-go_agent", "  name: bosh-vcloud-esxi-ubuntu-trusty-go_agent", 1), "cloud_properties.name is"},
+		{"image", strings.Replace(testManifest, "sha1: %v", "sha1: 0000%.0v", 1), "image doesn't match stemcell.MF's sha1 0000"},
+	} {
+		info, err := testInspect(t, tc.manifest, image)
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+		err = info.Check(spec, version)
+		if tc.want == "" {
+			if err != nil {
+				t.Errorf("%v: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: got %v, want an error saying %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestFetchStemcellQuarantinesWrongStemcell(t *testing.T) {
+	// Matches the checksums the mirror publishes, but is a different version
+	content := testStemcellTarball(t, strings.Replace(testManifest, "'3026.12'", "'3026.11'", -1), []byte("image"))
+	var log []string
+	opts := fakeFetchOptions(t, &fakeSource{Name: "mirror", Content: content, log: &log})
+	opts.SkipInspect = false
+	testChdir(t, t.TempDir())
+	spec := testSpec(t, testVsphere)
+	version := testVersion(t, "3026.12")
+
+	_, err := FetchStemcell(spec, version, opts, nil)
+	if err == nil || !strings.Contains(err.Error(), "version is '3026.11'") {
+		t.Fatalf("got error %v, want one about the version", err)
+	}
+	filename := spec.Filename(version)
+	if _, err := ioutil.ReadFile(filename + corruptFileSuffix); err != nil {
+		t.Errorf("wrong stemcell wasn't quarantined: %v", err)
+	}
+}
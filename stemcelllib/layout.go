@@ -0,0 +1,104 @@
+package stemcelllib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Puts every stemcell straight in the output directory under its upstream
+// filename
+const DefaultLayout = "{{.Filename}}"
+
+// What a layout template can use, e.g. "{{.OS}}/{{.Version}}/{{.Filename}}"
+type LayoutData struct {
+	Filename   string // upstream filename, e.g. bosh-stemcell-3026-vsphere-esxi-ubuntu-trusty-go_agent.tgz
+	Name       string // bosh.io name
+	Iaas       string
+	Hypervisor string
+	OS         string
+	Agent      string
+	Flavor     string // light or full for AWS, otherwise ""
+	Version    Version
+}
+
+// A parsed layout template
+type Layout struct {
+	tmpl *template.Template
+}
+
+func NewLayout(text string) (*Layout, error) {
+	if text == "" {
+		text = DefaultLayout
+	}
+	tmpl, err := template.New("layout").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("bad layout '%v': %v", text, err))
+	}
+	// Catch unknown fields now rather than once per stemcell
+	if err := tmpl.Execute(&bytes.Buffer{}, LayoutData{}); err != nil {
+		return nil, errors.New(fmt.Sprintf("bad layout '%v': %v", text, err))
+	}
+	return &Layout{tmpl: tmpl}, nil
+}
+
+// Where a stemcell goes, relative to the output directory.  The result has
+// to stay inside it.
+func (l *Layout) Path(spec StemcellSpec, version Version, stemcellFilename string) (string, error) {
+	data := LayoutData{
+		Filename:   stemcellFilename,
+		Name:       spec.BoshIoName(),
+		Iaas:       spec.Iaas,
+		Hypervisor: spec.Hypervisor,
+		OS:         spec.OS,
+		Agent:      spec.Agent,
+		Flavor:     spec.Flavor,
+		Version:    version,
+	}
+	var buf bytes.Buffer
+	if err := l.tmpl.Execute(&buf, data); err != nil {
+		return "", errors.New(fmt.Sprintf("bad layout: %v", err))
+	}
+	relPath := filepath.Clean(strings.TrimSpace(buf.String()))
+	if relPath == "." || filepath.IsAbs(relPath) || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", errors.New(fmt.Sprintf("layout puts %v at '%v', outside the output directory", spec.Label(), buf.String()))
+	}
+	return relPath, nil
+}
+
+// Where a stemcell goes, from opts.OutputDir and opts.Layout
+func (opts *FetchOptions) localPath(spec StemcellSpec, version Version, stemcellFilename string) (string, error) {
+	layout := opts.Layout
+	if layout == nil {
+		layout, _ = NewLayout(DefaultLayout)
+	}
+	relPath, err := layout.Path(spec, version, stemcellFilename)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(opts.OutputDir, relPath), nil
+}
+
+// Paths already taken in this run, so two stemcells that a layout maps to the
+// same file are caught instead of overwriting each other
+type pathClaims struct {
+	mu     sync.Mutex
+	claims map[string]string
+}
+
+func (pc *pathClaims) claim(path string, label string) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.claims == nil {
+		pc.claims = map[string]string{}
+	}
+	if other, ok := pc.claims[path]; ok && other != label {
+		return errors.New(fmt.Sprintf("%v and %v would both be written to %v (make the layout tell them apart, e.g. with {{.Filename}})", other, label, path))
+	}
+	pc.claims[path] = label
+	return nil
+}
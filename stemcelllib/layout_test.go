@@ -0,0 +1,142 @@
+package stemcelllib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewLayout(t *testing.T) {
+	for _, text := range []string{"", DefaultLayout, "{{.OS}}/{{.Iaas}}-{{.Hypervisor}}/{{.Version}}/{{.Filename}}"} {
+		if _, err := NewLayout(text); err != nil {
+			t.Errorf("%q: %v", text, err)
+		}
+	}
+	for _, text := range []string{"{{.Filename", "{{.Sha1}}/{{.Filename}}", "{{.Filename | nosuchfunc}}"} {
+		if _, err := NewLayout(text); err == nil {
+			t.Errorf("%q: got no error", text)
+		}
+	}
+}
+
+func TestLayoutPath(t *testing.T) {
+	aws := testSpec(t, "bosh-aws-xen-hvm-ubuntu-trusty-go_agent")
+	aws.Flavor = FlavorLight
+	version := testVersion(t, "3026.12")
+	filename := aws.Filename(version)
+
+	for _, tc := range []struct {
+		layout string
+		want   string
+	}{
+		{"", filename},
+		{"{{.OS}}/{{.Version}}/{{.Filename}}", filepath.Join("ubuntu-trusty", "3026.12", filename)},
+		{"{{.Iaas}}-{{.Hypervisor}}-{{.Agent}}/{{.Flavor}}/{{.Name}}.tgz", filepath.Join("aws-xen-hvm-go_agent", "light", "bosh-aws-xen-hvm-ubuntu-trusty-go_agent.tgz")},
+		{" {{.Version}}//./stemcell.tgz\n", filepath.Join("3026.12", "stemcell.tgz")},
+		{"a/../{{.Filename}}", filename},
+	} {
+		layout, err := NewLayout(tc.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := layout.Path(aws, version, filename)
+		if err != nil {
+			t.Errorf("%q: %v", tc.layout, err)
+		} else if got != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.layout, got, tc.want)
+		}
+	}
+
+	// Nothing may end up outside the output directory
+	for _, text := range []string{"../{{.Filename}}", "/tmp/{{.Filename}}", "{{.Flavor}}", "a/../..", "."} {
+		layout, err := NewLayout(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := layout.Path(testSpec(t, testVsphere), version, filename); err == nil {
+			t.Errorf("%q: got %v, want an error", text, got)
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	spec := testSpec(t, testVsphere)
+	version := testVersion(t, "3026")
+	layout, _ := NewLayout("{{.Iaas}}/{{.Filename}}")
+	for _, tc := range []struct {
+		opts *FetchOptions
+		want string
+	}{
+		{&FetchOptions{}, spec.Filename(version)},
+		{&FetchOptions{OutputDir: "out"}, filepath.Join("out", spec.Filename(version))},
+		{&FetchOptions{OutputDir: "/srv/stemcells", Layout: layout}, filepath.Join("/srv/stemcells", "vsphere", spec.Filename(version))},
+	} {
+		if got, err := tc.opts.localPath(spec, version, spec.Filename(version)); err != nil || got != tc.want {
+			t.Errorf("%+v: got %v (%v), want %v", tc.opts, got, err, tc.want)
+		}
+	}
+}
+
+func TestPathClaims(t *testing.T) {
+	var claims pathClaims
+	if err := claims.claim("out/a.tgz", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := claims.claim("out/a.tgz", "a"); err != nil {
+		t.Errorf("the same stemcell can claim its path again: %v", err)
+	}
+	if err := claims.claim("out/b.tgz", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := claims.claim("out/a.tgz", "b"); err == nil || !strings.Contains(err.Error(), "a and b would both be written to out/a.tgz") {
+		t.Errorf("got %v, want a collision", err)
+	}
+}
+
+func TestFetchStemcellLayout(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1000)
+	var log []string
+	testChdir(t, t.TempDir())
+	opts := fakeFetchOptions(t, &fakeSource{Name: "upstream", Content: content, log: &log})
+	opts.OutputDir = "out"
+	opts.Layout, _ = NewLayout("{{.Iaas}}/{{.Version}}/{{.Filename}}")
+	spec := testSpec(t, testVsphere)
+
+	result, err := FetchStemcell(spec, testVersion(t, "3026"), opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join("out", "vsphere", "3026", spec.Filename(testVersion(t, "3026")))
+	if result.Path != want {
+		t.Errorf("got path %v, want %v", result.Path, want)
+	}
+	if data, err := os.ReadFile(want); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("%v doesn't have the stemcell (%v)", want, err)
+	}
+}
+
+func TestLayoutCollisions(t *testing.T) {
+	var log []string
+	testChdir(t, t.TempDir())
+	opts := fakeFetchOptions(t, &fakeSource{Name: "upstream", Content: []byte("stemcell"), log: &log})
+	opts.Layout, _ = NewLayout("{{.Version}}.tgz")
+	specs := []StemcellSpec{testSpec(t, testVsphere), testSpec(t, testOpenstack)}
+	version := testVersion(t, "3026")
+
+	plans := PlanAll(specs, version, 1, opts)
+	if plans[0].Err != nil || plans[1].Err == nil || !strings.Contains(plans[1].Err.Error(), "would both be written to 3026.tgz") {
+		t.Errorf("got plan errors %v and %v, want the second to collide", plans[0].Err, plans[1].Err)
+	}
+
+	if _, err := FetchStemcell(specs[0], version, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FetchStemcell(specs[1], version, opts, nil); err == nil || !strings.Contains(err.Error(), "would both be written") {
+		t.Errorf("got %v, want a collision", err)
+	}
+	if data, _ := os.ReadFile("3026.tgz"); string(data) != "stemcell" {
+		t.Errorf("3026.tgz was overwritten")
+	}
+}
@@ -0,0 +1,117 @@
+package stemcelllib
+
+// Must install yaml:  go get -u gopkg.in/yaml.v2
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Machine-readable record of a fetch, written next to the stemcells
+type Manifest struct {
+	Stemcells []ManifestEntry `json:"stemcells" yaml:"stemcells"`
+}
+
+type ManifestEntry struct {
+	BoshIoName       string    `json:"bosh_io_name" yaml:"bosh_io_name"`
+	Flavor           string    `json:"flavor,omitempty" yaml:"flavor,omitempty"`
+	Version          Version   `json:"version" yaml:"version"`
+	Filename         string    `json:"filename,omitempty" yaml:"filename,omitempty"`
+	Path             string    `json:"path,omitempty" yaml:"path,omitempty"`
+	Source           string    `json:"source,omitempty" yaml:"source,omitempty"`
+	Url              string    `json:"url,omitempty" yaml:"url,omitempty"`
+	Size             int64     `json:"size" yaml:"size"`
+	Md5              string    `json:"md5,omitempty" yaml:"md5,omitempty"`
+	Sha1             string    `json:"sha1,omitempty" yaml:"sha1,omitempty"`
+	Sha256           string    `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	DownloadStarted  time.Time `json:"download_started" yaml:"download_started"`
+	DownloadFinished time.Time `json:"download_finished" yaml:"download_finished"`
+	FromCache        bool      `json:"from_cache" yaml:"from_cache"`
+	Error            string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func NewManifest(results []FetchResult) *Manifest {
+	m := &Manifest{Stemcells: []ManifestEntry{}}
+	for _, result := range results {
+		entry := ManifestEntry{
+			BoshIoName:       result.StemcellBoshIoName,
+			Flavor:           result.Flavor,
+			Version:          result.Version,
+			Filename:         result.StemcellFilename,
+			Path:             result.Path,
+			Source:           result.Source,
+			Url:              result.Url,
+			Size:             int64(result.StemcellBytes),
+			Md5:              result.Md5,
+			Sha1:             result.Sha1,
+			Sha256:           result.Sha256,
+			DownloadStarted:  result.Started,
+			DownloadFinished: result.Finished,
+			FromCache:        result.FromCache,
+		}
+		if result.Err != nil {
+			entry.Error = result.Err.Error()
+		}
+		m.Stemcells = append(m.Stemcells, entry)
+	}
+	return m
+}
+
+// Only the stemcells that were fetched successfully
+func (m *Manifest) Fetched() []ManifestEntry {
+	fetched := []ManifestEntry{}
+	for _, entry := range m.Stemcells {
+		if entry.Error == "" {
+			fetched = append(fetched, entry)
+		}
+	}
+	return fetched
+}
+
+// Writes YAML if the path ends in .yml or .yaml, otherwise JSON
+func WriteManifest(path string, m *Manifest) error {
+	var data []byte
+	var err error
+	if isYamlPath(path) {
+		data, err = yaml.Marshal(m)
+	} else {
+		data, err = json.MarshalIndent(m, "", "    ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data, isYamlPath(path))
+}
+
+func parseManifest(data []byte, isYaml bool) (*Manifest, error) {
+	var err error
+	m := &Manifest{}
+	if isYaml {
+		err = yaml.Unmarshal(data, m)
+	} else {
+		err = json.Unmarshal(data, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func isYamlPath(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yml" || ext == ".yaml"
+}
@@ -0,0 +1,79 @@
+package stemcelllib
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testResults(t *testing.T) []FetchResult {
+	started := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	return []FetchResult{
+		{
+			StemcellBoshIoName: testVsphere,
+			Version:            testVersion(t, "3026.12"),
+			StemcellFilename:   "bosh-stemcell-3026.12-vsphere-esxi-ubuntu-trusty-go_agent.tgz",
+			Url:                "https://example.com/bosh-stemcell-3026.12-vsphere-esxi-ubuntu-trusty-go_agent.tgz",
+			StemcellBytes:      1234,
+			Md5:                "md5",
+			Sha1:               "sha1",
+			Sha256:             "sha256",
+			Started:            started,
+			Finished:           started.Add(time.Minute),
+		},
+		{
+			StemcellBoshIoName: testOpenstack,
+			Version:            testVersion(t, "3026.12"),
+			Started:            started,
+			Finished:           started.Add(time.Second),
+			Err:                errors.New("HTTP 404"),
+		},
+	}
+}
+
+func TestNewManifest(t *testing.T) {
+	m := NewManifest(testResults(t))
+	if len(m.Stemcells) != 2 {
+		t.Fatalf("got %v entries, want 2", len(m.Stemcells))
+	}
+	entry := m.Stemcells[0]
+	if entry.BoshIoName != testVsphere || entry.Version.String() != "3026.12" || entry.Size != 1234 || entry.Sha256 != "sha256" || entry.Error != "" {
+		t.Errorf("got entry %+v", entry)
+	}
+	if m.Stemcells[1].Error != "HTTP 404" {
+		t.Errorf("got error %q for the failed stemcell", m.Stemcells[1].Error)
+	}
+	if fetched := m.Fetched(); len(fetched) != 1 || fetched[0].BoshIoName != testVsphere {
+		t.Errorf("got fetched %+v", fetched)
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	m := NewManifest(testResults(t))
+	for _, name := range []string{"manifest.json", "manifest.yml", "manifest.YAML"} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := WriteManifest(path, m); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		read, err := ReadManifest(path)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if !reflect.DeepEqual(read, m) {
+			t.Errorf("%v: got back %+v, want %+v", name, read, m)
+		}
+	}
+}
+
+func TestReadManifestBadVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	if err := ioutil.WriteFile(path, []byte(`{"stemcells": [{"bosh_io_name": "x", "version": "3026.x"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadManifest(path); err == nil {
+		t.Errorf("got no error for version 3026.x")
+	}
+}
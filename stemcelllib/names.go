@@ -0,0 +1,250 @@
+package stemcelllib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Defaults reproduce the original four trusty stemcells
+var DefaultIaases = []string{"aws", "vsphere", "vcloud", "openstack"}
+
+const DefaultOS = "ubuntu-trusty"
+const DefaultAgent = "go_agent"
+
+// Flavors of a stemcell.  Only AWS has both: the light stemcell just points
+// at published AMIs, the full one carries the image itself for regions and
+// partitions (e.g., GovCloud) the AMIs aren't published to.
+const FlavorLight = "light"
+const FlavorFull = "full"
+const FlavorBoth = "both"
+
+// Hypervisor bosh.io pairs with each IaaS when none is given
+var DefaultHypervisors = map[string]string{
+	"aws":       "xen-hvm",
+	"azure":     "hyperv",
+	"google":    "kvm",
+	"openstack": "kvm",
+	"vcloud":    "esxi",
+	"vsphere":   "esxi",
+	"warden":    "boshlite",
+}
+
+// Short names accepted for --os
+var osAliases = map[string]string{
+	"trusty": "ubuntu-trusty",
+	"xenial": "ubuntu-xenial",
+	"bionic": "ubuntu-bionic",
+	"jammy":  "ubuntu-jammy",
+}
+
+// The parts a bosh.io stemcell name is built from, e.g.
+// bosh-<iaas>-<hypervisor>-<os>-<agent><suffix>
+type StemcellSpec struct {
+	Iaas       string
+	Hypervisor string
+	OS         string
+	Agent      string
+	Suffix     string // e.g. "-raw" for the trusty openstack stemcell
+	Flavor     string // FlavorLight or FlavorFull for AWS, otherwise ""
+}
+
+func (spec StemcellSpec) BoshIoName() string {
+	return fmt.Sprintf("bosh-%v-%v-%v-%v%v", spec.Iaas, spec.Hypervisor, spec.OS, spec.Agent, spec.Suffix)
+}
+
+// The filename bosh.io serves a version of this stemcell as, e.g.
+// light-bosh-stemcell-3312.7-aws-xen-hvm-ubuntu-trusty-go_agent.tgz
+func (spec StemcellSpec) Filename(version Version) string {
+	prefix := ""
+	if spec.Flavor == FlavorLight {
+		prefix = "light-"
+	}
+	return fmt.Sprintf("%vbosh-stemcell-%v-%v.tgz", prefix, version, strings.TrimPrefix(spec.BoshIoName(), "bosh-"))
+}
+
+// Name plus flavor, to tell the light and full AWS stemcells apart
+func (spec StemcellSpec) Label() string {
+	if spec.Flavor == "" {
+		return spec.BoshIoName()
+	}
+	return fmt.Sprintf("%v (%v)", spec.BoshIoName(), spec.Flavor)
+}
+
+// Splits a bosh.io stemcell name back into its parts
+func ParseBoshIoName(stemcellBoshIoName string) (spec StemcellSpec, errRet error) {
+	if !strings.HasPrefix(stemcellBoshIoName, "bosh-") {
+		errRet = errors.New(fmt.Sprintf("'%v' is not a bosh.io stemcell name (must start with 'bosh-')", stemcellBoshIoName))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(stemcellBoshIoName, "bosh-"), "-")
+
+	// The OS is the first recognizable part after the IaaS and hypervisor
+	osStart, osEnd := -1, -1
+	for i := 2; i < len(parts); i++ {
+		if (parts[i] == "ubuntu" || parts[i] == "centos") && i+1 < len(parts) {
+			osStart, osEnd = i, i+2
+			break
+		}
+		if strings.HasPrefix(parts[i], "windows") {
+			osStart, osEnd = i, i+1
+			break
+		}
+	}
+	if osStart < 0 || osEnd >= len(parts) {
+		errRet = errors.New(fmt.Sprintf("can't find the OS and agent in stemcell name '%v'", stemcellBoshIoName))
+		return
+	}
+
+	spec.Iaas = parts[0]
+	spec.Hypervisor = strings.Join(parts[1:osStart], "-")
+	spec.OS = strings.Join(parts[osStart:osEnd], "-")
+	spec.Agent = parts[osEnd]
+	if osEnd+1 < len(parts) {
+		spec.Suffix = "-" + strings.Join(parts[osEnd+1:], "-")
+	}
+	return
+}
+
+// Builds the stemcells to fetch from the cross product of IaaSes and OSes.
+// Empty lists fall back to the defaults.  Each hypervisor is either
+// "<hypervisor>" (used for every IaaS) or "<iaas>=<hypervisor>".
+func SelectStemcells(iaases []string, oses []string, hypervisors []string, agent string) ([]StemcellSpec, error) {
+	if len(iaases) == 0 {
+		iaases = DefaultIaases
+	}
+	if len(oses) == 0 {
+		oses = []string{DefaultOS}
+	}
+	if agent == "" {
+		agent = DefaultAgent
+	}
+
+	hypervisorFor := map[string]string{}
+	for iaas, hypervisor := range DefaultHypervisors {
+		hypervisorFor[iaas] = hypervisor
+	}
+	for _, h := range hypervisors {
+		if kv := strings.SplitN(h, "=", 2); len(kv) == 2 {
+			hypervisorFor[kv[0]] = kv[1]
+		} else {
+			for _, iaas := range iaases {
+				hypervisorFor[iaas] = h
+			}
+		}
+	}
+
+	specs := []StemcellSpec{}
+	for _, osName := range oses {
+		if alias, ok := osAliases[osName]; ok {
+			osName = alias
+		}
+		for _, iaas := range iaases {
+			hypervisor, ok := hypervisorFor[iaas]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("unknown IaaS '%v' (known: %v); give its hypervisor with --hypervisor %v=HYPERVISOR", iaas, strings.Join(knownIaases(), ", "), iaas))
+			}
+			spec := StemcellSpec{Iaas: iaas, Hypervisor: hypervisor, OS: osName, Agent: agent}
+			if iaas == "openstack" && osName == "ubuntu-trusty" {
+				// Only the raw disk format of the trusty openstack stemcell is on bosh.io
+				spec.Suffix = "-raw"
+			}
+			specs = append(specs, spec)
+		}
+	}
+	return specs, nil
+}
+
+// Sets which AWS stemcells to fetch: FlavorLight, FlavorFull or FlavorBoth
+// (which fetches each AWS stemcell twice, once in each flavor)
+func ApplyAwsFlavor(specs []StemcellSpec, awsFlavor string) ([]StemcellSpec, error) {
+	var flavors []string
+	switch awsFlavor {
+	case FlavorLight, "":
+		flavors = []string{FlavorLight}
+	case FlavorFull:
+		flavors = []string{FlavorFull}
+	case FlavorBoth:
+		flavors = []string{FlavorLight, FlavorFull}
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown AWS flavor '%v' (must be light, full or both)", awsFlavor))
+	}
+
+	flavored := []StemcellSpec{}
+	for _, spec := range specs {
+		if spec.Iaas != "aws" {
+			flavored = append(flavored, spec)
+			continue
+		}
+		for _, flavor := range flavors {
+			spec.Flavor = flavor
+			flavored = append(flavored, spec)
+		}
+	}
+	return flavored, nil
+}
+
+// Specs for a list of bosh.io stemcell names
+func SpecsFromNames(stemcellBoshIoNames []string) ([]StemcellSpec, error) {
+	specs := make([]StemcellSpec, 0, len(stemcellBoshIoNames))
+	for _, name := range stemcellBoshIoNames {
+		spec, err := ParseBoshIoName(name)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// bosh.io names of the specs, each listed once
+func BoshIoNames(specs []StemcellSpec) []string {
+	names := make([]string, 0, len(specs))
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		if name := spec.BoshIoName(); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Reads a list of bosh.io stemcell names, one per line.  Blank lines and
+// lines starting with '#' are skipped.
+func ReadStemcellList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := []string{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := ParseBoshIoName(line); err != nil {
+			return nil, errors.New(fmt.Sprintf("%v:%v: %v", path, lineNum, err))
+		}
+		names = append(names, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func knownIaases() []string {
+	iaases := []string{}
+	for iaas := range DefaultHypervisors {
+		iaases = append(iaases, iaas)
+	}
+	sort.Strings(iaases)
+	return iaases
+}
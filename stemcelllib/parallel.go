@@ -0,0 +1,55 @@
+package stemcelllib
+
+import (
+	"sync"
+
+	"github.com/mgoelzer/stemcells/progresslib"
+)
+
+const DefaultParallel = 4
+
+// Fetches all the named stemcells using at most `parallel` concurrent
+// downloads.  A failed download does not stop the others; check Err on each
+// result, which come back in the same order as specs.  Progress goes to
+// reporter (nil for none).
+func FetchAll(specs []StemcellSpec, version Version, parallel int, opts *FetchOptions, reporter progresslib.ProgressReporter) []FetchResult {
+	if parallel < 1 {
+		parallel = 1
+	}
+	results := make([]FetchResult, len(specs))
+	labels := make([]string, len(specs))
+	for i, spec := range specs {
+		labels[i] = spec.Label()
+	}
+	if reporter == nil {
+		reporter = progresslib.NoProgress{}
+	}
+	reporter.Begin(labels)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				reporter.Start(i)
+				progress := func(dlnow, dltotal float64) {
+					reporter.Update(i, int64(dlnow), int64(dltotal))
+				}
+				result, err := FetchStemcell(specs[i], version, opts, progress)
+				result.Err = err
+				results[i] = result
+				reporter.Finish(i, result.Path, int64(result.StemcellBytes), err)
+			}
+		}()
+	}
+	for i := range specs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	reporter.End()
+
+	return results
+}
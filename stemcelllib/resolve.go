@@ -0,0 +1,80 @@
+package stemcelllib
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const latestQuery = "latest"
+
+var majorLatestRegexp = regexp.MustCompile(`^([0-9]+)\.latest$`)
+
+// True for version queries that need bosh.io to answer: "latest" or
+// "<major>.latest"
+func IsVersionQuery(query string) bool {
+	return query == latestQuery || majorLatestRegexp.MatchString(query)
+}
+
+// Asks bosh.io which version a query means for every stemcell and returns it.
+// All the stemcells have to agree; a release with e.g. aws at 3026.12 but
+// vsphere at 3026.11 is an error.  Anything else is parsed as an exact version.
+func ResolveVersion(stemcellBoshIoNames []string, query string, opts *FetchOptions) (Version, error) {
+	if !IsVersionQuery(query) {
+		return ParseVersion(query)
+	}
+
+	resolved := map[string]Version{}
+	for _, stemcellBoshIoName := range stemcellBoshIoNames {
+		stemcells, err := GetBoshIoStemcells(stemcellBoshIoName, opts)
+		if err != nil {
+			return Version{}, err
+		}
+		version, err := pickVersion(stemcells, query)
+		if err != nil {
+			return Version{}, errors.New(fmt.Sprintf("%v: %v", stemcellBoshIoName, err))
+		}
+		resolved[stemcellBoshIoName] = version
+	}
+
+	version := resolved[stemcellBoshIoNames[0]]
+	for _, stemcellBoshIoName := range stemcellBoshIoNames[1:] {
+		if !resolved[stemcellBoshIoName].Equal(version) {
+			lines := []string{}
+			for _, name := range stemcellBoshIoNames {
+				lines = append(lines, fmt.Sprintf("  %v: %v", name, resolved[name]))
+			}
+			return Version{}, errors.New(fmt.Sprintf("'%v' is not the same version for every stemcell:\n%v", query, strings.Join(lines, "\n")))
+		}
+	}
+	return version, nil
+}
+
+// Highest version on bosh.io matching the query
+func pickVersion(stemcells []BoshIoStemcell, query string) (Version, error) {
+	// -1 for plain "latest"; "0.latest" has to match major 0 like any other
+	major := -1
+	if m := majorLatestRegexp.FindStringSubmatch(query); m != nil {
+		major, _ = strconv.Atoi(m[1])
+	}
+	var latest Version
+	for _, stemcell := range stemcells {
+		version, err := ParseVersion(stemcell.Version)
+		if err != nil {
+			// Not something we could fetch anyway
+			continue
+		}
+		if major >= 0 && version.Major() != major {
+			continue
+		}
+		if latest.IsZero() || version.Compare(latest) > 0 {
+			latest = version
+		}
+	}
+	if latest.IsZero() {
+		return Version{}, errors.New(fmt.Sprintf("no version on bosh.io matches '%v'", query))
+	}
+	return latest, nil
+}
@@ -0,0 +1,409 @@
+package stemcelllib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Somewhere stemcells can be fetched from.  FetchStemcell tries its sources
+// in order until one of them works.
+type Source interface {
+	String() string
+
+	// Works out which file a stemcell version is, where it is, and what it
+	// should hash to
+	Locate(spec StemcellSpec, version Version, opts *FetchOptions) (*LocatedStemcell, error)
+
+	// Opens a located stemcell, starting at offset if the source can
+	Open(loc *LocatedStemcell, offset int64, opts *FetchOptions) (*OpenedStemcell, error)
+
+	// Finds out how big a located stemcell is and where it really is,
+	// without fetching it
+	Head(loc *LocatedStemcell, opts *FetchOptions) (*StemcellHead, error)
+}
+
+type LocatedStemcell struct {
+	Filename       string
+	Url            string              // where the file is (after any redirect)
+	RedirectedFrom []string            // URLs that led to Url, if any
+	Published      *BoshIoStemcellFile // expected size and checksums
+}
+
+type StemcellHead struct {
+	RedirectChain []string // every URL visited, ending with the file itself
+	Size          int64    // Content-Length, or -1 if unknown
+}
+
+type OpenedStemcell struct {
+	Body   io.ReadCloser
+	Offset int64  // where Body starts; 0 if the source couldn't resume
+	Size   int64  // of the whole file, or -1 if unknown
+	Url    string // where the bytes really come from
+}
+
+// Builds a source from its command line form: "bosh.io" itself,
+// "redirector:URL" for a bosh.io-style redirector and API (e.g. a mirror),
+// "http(s)://HOST/PATH" for a plain directory of stemcells served over HTTP
+// (S3-compatible buckets included), or "file:///PATH" or just a path for a
+// local directory of stemcells.
+func ParseSource(s string) (Source, error) {
+	switch {
+	case s == "bosh.io":
+		return NewBoshIoSource(BoshIoUrl), nil
+	case strings.HasPrefix(s, "redirector:"):
+		return NewBoshIoSource(strings.TrimPrefix(s, "redirector:")), nil
+	case strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://"):
+		return NewHttpDirSource(s), nil
+	case strings.HasPrefix(s, "file://"):
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		return NewLocalDirSource(u.Path), nil
+	case s != "":
+		return NewLocalDirSource(s), nil
+	}
+	return nil, errors.New("empty stemcell source")
+}
+
+// bosh.io, or anything that redirects and publishes checksums the same way
+
+type BoshIoSource struct {
+	Url string
+}
+
+func NewBoshIoSource(baseUrl string) *BoshIoSource {
+	return &BoshIoSource{Url: strings.TrimRight(baseUrl, "/")}
+}
+
+func (s *BoshIoSource) String() string {
+	return s.Url
+}
+
+func (s *BoshIoSource) Locate(spec StemcellSpec, version Version, opts *FetchOptions) (*LocatedStemcell, error) {
+	stemcellBoshIoName := spec.BoshIoName()
+	if spec.Flavor == FlavorFull {
+		// bosh.io only redirects to the light AWS stemcell, so the full one
+		// comes straight from where the API says it is
+		stemcell, err := getPublishedStemcell(s.Url, stemcellBoshIoName, version, opts)
+		if err != nil {
+			return nil, err
+		}
+		if stemcell.Regular == nil || stemcell.Regular.Url == "" {
+			return nil, errors.New(fmt.Sprintf("no full stemcell for %v version %v", stemcellBoshIoName, version))
+		}
+		return &LocatedStemcell{Filename: filenameFromUrl(stemcell.Regular.Url), Url: stemcell.Regular.Url, Published: stemcell.Regular}, nil
+	}
+
+	// Get the name in "Location:" header without actually redirecting yet
+	stemcellUrl := s.Url + "/d/stemcells/" + fmt.Sprintf("%v?v=%v", stemcellBoshIoName, version)
+	locationString, err := opts.downloader().Resolve(stemcellUrl)
+	if err != nil {
+		return nil, err
+	}
+	stemcellFilename := filenameFromUrl(locationString)
+	if stemcellFilename == "" {
+		return nil, errors.New(fmt.Sprintf("can't tell the stemcell filename from %v", locationString))
+	}
+
+	// Find out what we should end up with before spending time downloading
+	published, err := getPublishedStemcellFile(s.Url, stemcellBoshIoName, version, stemcellFilename, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &LocatedStemcell{Filename: stemcellFilename, Url: locationString, RedirectedFrom: []string{stemcellUrl}, Published: published}, nil
+}
+
+func (s *BoshIoSource) Open(loc *LocatedStemcell, offset int64, opts *FetchOptions) (*OpenedStemcell, error) {
+	return openHttp(opts.downloader(), loc, offset)
+}
+
+func (s *BoshIoSource) Head(loc *LocatedStemcell, opts *FetchOptions) (*StemcellHead, error) {
+	return headHttp(opts.downloader(), loc)
+}
+
+// A directory of stemcells served over HTTP, under their bosh.io filenames.
+// Checksums come from <filename>.sha256/.sha1 files or a stemcells.json
+// manifest next to them, or else from the bosh.io API.
+
+type HttpDirSource struct {
+	Url string
+}
+
+func NewHttpDirSource(baseUrl string) *HttpDirSource {
+	return &HttpDirSource{Url: strings.TrimRight(baseUrl, "/")}
+}
+
+func (s *HttpDirSource) String() string {
+	return s.Url
+}
+
+// Each file is asked for by name rather than looked for in a listing, since
+// S3 bucket listings stop at 1000 keys and not every server lists at all
+func (s *HttpDirSource) Locate(spec StemcellSpec, version Version, opts *FetchOptions) (*LocatedStemcell, error) {
+	d := opts.downloader()
+	stemcellFilename := spec.Filename(version)
+	stemcellUrl := s.Url + "/" + url.PathEscape(stemcellFilename)
+	found, err := s.exists(d, stemcellUrl)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New(fmt.Sprintf("%v is not in %v", stemcellFilename, s.Url))
+	}
+	published, err := mirrorChecksums(spec, version, stemcellFilename, opts, func(name string) ([]byte, error) {
+		return s.get(d, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &LocatedStemcell{Filename: stemcellFilename, Url: stemcellUrl, Published: published}, nil
+}
+
+// Whether a file is there, by HEAD or, for servers that don't do HEAD, the
+// start of a GET
+func (s *HttpDirSource) exists(d Downloader, fileUrl string) (bool, error) {
+	resp, err := d.Head(fileUrl)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		if resp, err = d.Get(fileUrl, 0); err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden:
+		// S3 says 403 for a missing key when the bucket can't be listed
+		return false, nil
+	}
+	return false, errors.New(fmt.Sprintf("%v returned HTTP %v", fileUrl, resp.Status))
+}
+
+func (s *HttpDirSource) Open(loc *LocatedStemcell, offset int64, opts *FetchOptions) (*OpenedStemcell, error) {
+	return openHttp(opts.downloader(), loc, offset)
+}
+
+func (s *HttpDirSource) Head(loc *LocatedStemcell, opts *FetchOptions) (*StemcellHead, error) {
+	return headHttp(opts.downloader(), loc)
+}
+
+// GETs a small file from the directory; os.ErrNotExist if it isn't there
+func (s *HttpDirSource) get(d Downloader, name string) ([]byte, error) {
+	u := s.Url + "/" + url.PathEscape(name)
+	resp, err := d.Get(u, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("%v returned HTTP %v", u, resp.Status))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// A local directory of stemcells under their bosh.io filenames, with
+// checksums found the same way as for HttpDirSource
+
+type LocalDirSource struct {
+	Dir string
+}
+
+func NewLocalDirSource(dir string) *LocalDirSource {
+	return &LocalDirSource{Dir: dir}
+}
+
+func (s *LocalDirSource) String() string {
+	return "file://" + s.Dir
+}
+
+func (s *LocalDirSource) Locate(spec StemcellSpec, version Version, opts *FetchOptions) (*LocatedStemcell, error) {
+	stemcellFilename := spec.Filename(version)
+	path := filepath.Join(s.Dir, stemcellFilename)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	published, err := mirrorChecksums(spec, version, stemcellFilename, opts, func(name string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(s.Dir, name))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if published.Size == 0 {
+		published.Size = info.Size()
+	}
+	return &LocatedStemcell{Filename: stemcellFilename, Url: "file://" + path, Published: published}, nil
+}
+
+func (s *LocalDirSource) Open(loc *LocatedStemcell, offset int64, opts *FetchOptions) (*OpenedStemcell, error) {
+	path := filepath.Join(s.Dir, loc.Filename)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if offset > info.Size() {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &OpenedStemcell{Body: f, Offset: offset, Size: info.Size(), Url: loc.Url}, nil
+}
+
+func (s *LocalDirSource) Head(loc *LocatedStemcell, opts *FetchOptions) (*StemcellHead, error) {
+	info, err := os.Stat(filepath.Join(s.Dir, loc.Filename))
+	if err != nil {
+		return nil, err
+	}
+	return &StemcellHead{RedirectChain: []string{loc.Url}, Size: info.Size()}, nil
+}
+
+// Expected checksums for a stemcell in a mirror directory.  readFile reads
+// another file from the same directory.
+func mirrorChecksums(spec StemcellSpec, version Version, stemcellFilename string, opts *FetchOptions, readFile func(name string) ([]byte, error)) (*BoshIoStemcellFile, error) {
+	published := &BoshIoStemcellFile{}
+	sidecars := []struct {
+		suffix string
+		sum    *string
+	}{
+		{".sha256", &published.Sha256},
+		{".sha1", &published.Sha1},
+		{".md5", &published.Md5},
+	}
+	for _, sidecar := range sidecars {
+		if data, err := readFile(stemcellFilename + sidecar.suffix); err == nil {
+			// Either just the checksum or sha256sum-style "<checksum>  <filename>"
+			if fields := strings.Fields(string(data)); len(fields) > 0 {
+				*sidecar.sum = fields[0]
+			}
+		}
+	}
+	if published.Sha256 != "" || published.Sha1 != "" {
+		return published, nil
+	}
+
+	// A directory filled by an earlier run with --manifest
+	for _, name := range []string{"stemcells.json", "stemcells.yml", "stemcells.yaml"} {
+		data, err := readFile(name)
+		if err != nil {
+			continue
+		}
+		m, err := parseManifest(data, isYamlPath(name))
+		if err != nil {
+			continue
+		}
+		for _, entry := range m.Fetched() {
+			if entry.Filename == stemcellFilename && (entry.Sha256 != "" || entry.Sha1 != "") {
+				return &BoshIoStemcellFile{Size: entry.Size, Md5: entry.Md5, Sha1: entry.Sha1, Sha256: entry.Sha256}, nil
+			}
+		}
+	}
+
+	// Last resort, which only works if bosh.io is reachable
+	published, err := GetPublishedStemcellFile(spec.BoshIoName(), version, stemcellFilename, opts)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("no checksums for %v (no .sha256/.sha1 file or manifest, and bosh.io: %v)", stemcellFilename, err))
+	}
+	return published, nil
+}
+
+// GETs a located file over HTTP from offset on, falling back to the whole
+// file when the server can't resume
+func openHttp(d Downloader, loc *LocatedStemcell, offset int64) (*OpenedStemcell, error) {
+	fileUrl := loc.Url
+	resp, err := d.Get(fileUrl, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && contentRangeStart(resp) == offset:
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 && offset == expectedSize(resp, loc):
+		// The .part file already has every byte (e.g., the last run was
+		// stopped before renaming it), so there's nothing left to send
+		resp.Body.Close()
+		return &OpenedStemcell{Body: http.NoBody, Offset: offset, Size: offset, Url: resp.Request.URL.String()}, nil
+	case resp.StatusCode == http.StatusOK:
+		// Server ignored the Range header (or there wasn't one) and is
+		// sending the whole file
+		offset = 0
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable || resp.StatusCode == http.StatusPartialContent:
+		// A .part file the server can't resume (e.g., it changed upstream)
+		// is fetched again in full
+		resp.Body.Close()
+		offset = 0
+		if resp, err = d.Get(fileUrl, 0); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("%v returned HTTP %v", fileUrl, resp.Status))
+	}
+
+	size := int64(-1)
+	if resp.ContentLength >= 0 {
+		size = offset + resp.ContentLength
+	}
+	return &OpenedStemcell{Body: resp.Body, Offset: offset, Size: size, Url: resp.Request.URL.String()}, nil
+}
+
+// HEADs a located stemcell, following any further redirects
+func headHttp(d Downloader, loc *LocatedStemcell) (*StemcellHead, error) {
+	resp, err := d.Head(loc.Url)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("HEAD %v returned HTTP %v", loc.Url, resp.Status))
+	}
+	chain := append(append([]string{}, loc.RedirectedFrom...), redirectChain(resp)...)
+	return &StemcellHead{RedirectChain: chain, Size: resp.ContentLength}, nil
+}
+
+// The size of the whole file, from the Content-Range of a 416 ("bytes */N")
+// or else what was published, or -1 if neither says
+func expectedSize(resp *http.Response, loc *LocatedStemcell) int64 {
+	contentRange := resp.Header.Get("Content-Range")
+	if i := strings.LastIndex(contentRange, "/"); i >= 0 {
+		if total, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+			return total
+		}
+	}
+	if loc.Published != nil && loc.Published.Size > 0 {
+		return loc.Published.Size
+	}
+	return -1
+}
+
+// Where a 206 response's body starts, or -1 if it can't be told
+func contentRangeStart(resp *http.Response) int64 {
+	var start, end, total int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return -1
+	}
+	return start
+}
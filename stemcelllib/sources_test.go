@@ -0,0 +1,62 @@
+package stemcelllib
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenHttpRangeNotSatisfiable(t *testing.T) {
+	content := []byte("0123456789")
+	for _, tc := range []struct {
+		name         string
+		contentRange string // of the 416
+		published    int64  // size, 0 for unknown
+		offset       int64
+		wantOffset   int64
+		wantGets     int
+	}{
+		{"complete by Content-Range", "bytes */10", 0, 10, 10, 1},
+		{"complete by published size", "", 10, 10, 10, 1},
+		{"too long", "bytes */10", 10, 12, 0, 2},
+		{"too long by published size", "", 10, 12, 0, 2},
+		{"size unknown", "", 0, 10, 0, 2},
+		{"Content-Range wins", "bytes */12", 10, 10, 0, 2},
+	} {
+		var gets int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gets++
+			if r.Header.Get("Range") != "" {
+				if tc.contentRange != "" {
+					w.Header().Set("Content-Range", tc.contentRange)
+				}
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Write(content)
+		}))
+		loc := &LocatedStemcell{Url: server.URL + "/stemcell.tgz", Published: &BoshIoStemcellFile{Size: tc.published}}
+
+		opened, err := openHttp(NewHttpDownloader(&http.Client{}), loc, tc.offset)
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			server.Close()
+			continue
+		}
+		body, _ := io.ReadAll(opened.Body)
+		opened.Body.Close()
+		server.Close()
+		if opened.Offset != tc.wantOffset || gets != tc.wantGets {
+			t.Errorf("%v: got offset %v after %v GETs, want %v after %v", tc.name, opened.Offset, gets, tc.wantOffset, tc.wantGets)
+		}
+		want := content
+		if tc.wantOffset > 0 {
+			want = nil
+		}
+		if !bytes.Equal(body, want) {
+			t.Errorf("%v: got body %q, want %q", tc.name, body, want)
+		}
+	}
+}
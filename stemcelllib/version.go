@@ -0,0 +1,101 @@
+package stemcelllib
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Largest number allowed in any part of a version
+const maxVersionPart = 99999
+
+// A stemcell version such as 3026, 3026.12, 621.74 or 1.260
+type Version struct {
+	parts []int
+}
+
+func ParseVersion(s string) (Version, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Version{}, errors.New("empty version")
+	}
+	var v Version
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || part == "" || strings.HasPrefix(part, "+") || strings.HasPrefix(part, "-") {
+			return Version{}, errors.New(fmt.Sprintf("'%v' is not a stemcell version (expected e.g. 3026 or 3026.12)", s))
+		}
+		if n > maxVersionPart {
+			return Version{}, errors.New(fmt.Sprintf("'%v' is not a stemcell version (%v is too big)", s, n))
+		}
+		v.parts = append(v.parts, n)
+	}
+	if v.parts[0] <= 0 {
+		return Version{}, errors.New(fmt.Sprintf("'%v' is not a stemcell version (must start with a number from 1 to %v)", s, maxVersionPart))
+	}
+	return v, nil
+}
+
+func (v Version) String() string {
+	strs := make([]string, len(v.parts))
+	for i, n := range v.parts {
+		strs[i] = strconv.Itoa(n)
+	}
+	return strings.Join(strs, ".")
+}
+
+func (v Version) IsZero() bool {
+	return len(v.parts) == 0
+}
+
+// The stemcell line, e.g. 3026 for 3026.12
+func (v Version) Major() int {
+	if v.IsZero() {
+		return 0
+	}
+	return v.parts[0]
+}
+
+// Returns -1, 0 or 1 as v is older than, the same as or newer than o.  A
+// missing part counts as older, so 3026 < 3026.0 < 3026.1.
+func (v Version) Compare(o Version) int {
+	for i := 0; i < len(v.parts) || i < len(o.parts); i++ {
+		vNum, oNum := -1, -1
+		if i < len(v.parts) {
+			vNum = v.parts[i]
+		}
+		if i < len(o.parts) {
+			oNum = o.parts[i]
+		}
+		if vNum < oNum {
+			return -1
+		}
+		if vNum > oNum {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (v Version) Equal(o Version) bool {
+	return v.Compare(o) == 0
+}
+
+// So versions read and write as plain strings in JSON and YAML
+func (v Version) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+func (v *Version) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*v = Version{}
+		return nil
+	}
+	parsed, err := ParseVersion(string(text))
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
@@ -0,0 +1,109 @@
+package stemcelllib
+
+import (
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want string
+	}{
+		{"3026", "3026"},
+		{"3026.12", "3026.12"},
+		{"621.74", "621.74"},
+		{"1.260", "1.260"},
+		{"3026.0", "3026.0"}, // not the same version as 3026
+		{" 3026.12 ", "3026.12"},
+		{"03026.012", "3026.12"}, // leading zeros are dropped
+		{"99999.99999", "99999.99999"},
+	} {
+		version, err := ParseVersion(tc.s)
+		if err != nil {
+			t.Errorf("%q: %v", tc.s, err)
+			continue
+		}
+		if version.String() != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.s, version, tc.want)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"latest",
+		"3026.latest",
+		"3026.",   // missing minor
+		".12",     // missing major
+		"3026..1", // missing middle part
+		"3026.12a",
+		"v3026",
+		"3026-12",
+		"+3026",
+		"3026.-1",
+		"0",
+		"0.12",
+		"100000",
+		"3026.100000",
+	} {
+		if version, err := ParseVersion(s); err == nil {
+			t.Errorf("%q: got %v, want an error", s, version)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"3026", "3026", 0},
+		{"3026", "3027", -1},
+		{"3027", "3026.12", 1},
+		{"3026.9", "3026.12", -1}, // numerically, not as strings
+		{"3026", "3026.0", -1},    // a missing part is older than any number
+		{"3026.0", "3026.1", -1},
+		{"3026.12", "3026.12.1", -1},
+		{"03026.12", "3026.12", 0},
+		{"621.74", "1.260", 1},
+	} {
+		a, _ := ParseVersion(tc.a)
+		b, _ := ParseVersion(tc.b)
+		if got := a.Compare(b); got != tc.want {
+			t.Errorf("%v vs %v: got %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+		if got := b.Compare(a); got != -tc.want {
+			t.Errorf("%v vs %v: got %v, want %v", tc.b, tc.a, got, -tc.want)
+		}
+		if a.Equal(b) != (tc.want == 0) {
+			t.Errorf("%v equal to %v: got %v", tc.a, tc.b, a.Equal(b))
+		}
+	}
+}
+
+func TestPickVersion(t *testing.T) {
+	stemcells := []BoshIoStemcell{}
+	for _, v := range []string{"3026.9", "3027", "3026.12", "latest", "2989.1", "0.9"} {
+		stemcells = append(stemcells, BoshIoStemcell{Version: v})
+	}
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"latest", "3027"},
+		{"3026.latest", "3026.12"},
+		{"2989.latest", "2989.1"},
+		{"1.latest", ""},
+		{"0.latest", ""}, // 0.9 doesn't parse, and plain latest is no fallback
+	} {
+		version, err := pickVersion(stemcells, tc.query)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%v: got %v, want an error", tc.query, version)
+			}
+			continue
+		}
+		if err != nil || version.String() != tc.want {
+			t.Errorf("%v: got %v (%v), want %v", tc.query, version, err, tc.want)
+		}
+	}
+}